@@ -0,0 +1,434 @@
+// Package bolt implements a stream storage backend on an embedded bbolt database.
+// Many streams can share one database, each stream is stored in its own bucket
+// under the "streams" bucket, so the database can also hold other buckets.
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/statestream"
+	bbolt "go.etcd.io/bbolt"
+)
+
+var streamsBucket = []byte("streams")
+var entriesBucket = []byte("entries")
+var snapshotsBucket = []byte("snapshots")
+
+// A storage backend for a single stream in a bbolt database.
+//
+// Keys are the big-endian timestamp followed by the entry type, so lookups are
+// seeks on a bbolt cursor. Snapshot keys are also stored in a separate bucket,
+// so GetSnapshotBefore is a single seek.
+type Backend struct {
+	db       *bbolt.DB
+	streamId []byte
+
+	subscribers    []chan<- *stream.StreamEntry
+	subscribersMtx sync.RWMutex
+}
+
+// Open the stream with the ID in db, creating its bucket if needed.
+func NewBackend(db *bbolt.DB, streamId string) (*Backend, error) {
+	if streamId == "" {
+		return nil, errors.New("Stream ID must be defined.")
+	}
+	b := &Backend{db: db, streamId: []byte(streamId)}
+	err := db.Update(func(tx *bbolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(streamsBucket)
+		if err != nil {
+			return err
+		}
+		bkt, err := root.CreateBucketIfNotExists(b.streamId)
+		if err != nil {
+			return err
+		}
+		if _, err := bkt.CreateBucketIfNotExists(entriesBucket); err != nil {
+			return err
+		}
+		_, err = bkt.CreateBucketIfNotExists(snapshotsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Encode a timestamp so the byte order matches time order.
+func encodeTimestamp(timestamp time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(timestamp.UnixNano())^(1<<63))
+	return key
+}
+
+func decodeTimestamp(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[:8])^(1<<63)))
+}
+
+func encodeKey(timestamp time.Time, entryType stream.StreamEntryType) []byte {
+	return append(encodeTimestamp(timestamp), byte(entryType))
+}
+
+func decodeEntry(key, value []byte) (*stream.StreamEntry, error) {
+	if len(key) != 9 {
+		return nil, errors.New("Invalid entry key in database.")
+	}
+	entry := &stream.StreamEntry{
+		Timestamp: decodeTimestamp(key),
+		Type:      stream.StreamEntryType(key[8]),
+	}
+	if err := json.Unmarshal(value, &entry.Data); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (b *Backend) buckets(tx *bbolt.Tx) (entries *bbolt.Bucket, snapshots *bbolt.Bucket, err error) {
+	var bkt *bbolt.Bucket
+	if root := tx.Bucket(streamsBucket); root != nil {
+		bkt = root.Bucket(b.streamId)
+	}
+	if bkt == nil {
+		return nil, nil, errors.New("Stream bucket does not exist.")
+	}
+	return bkt.Bucket(entriesBucket), bkt.Bucket(snapshotsBucket), nil
+}
+
+// Retrieve the first snapshot before timestamp. Return nil for no data.
+func (b *Backend) GetSnapshotBefore(timestamp time.Time) (entry *stream.StreamEntry, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		entries, snapshots, err := b.buckets(tx)
+		if err != nil {
+			return err
+		}
+		c := snapshots.Cursor()
+		// Seek to the first key at or after timestamp, then step back.
+		k, _ := c.Seek(encodeTimestamp(timestamp))
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+		if k == nil {
+			return nil
+		}
+		entry, err = decodeEntry(k, entries.Get(k))
+		return err
+	})
+	return
+}
+
+// Get the next entry after the timestamp. Return nil for no data.
+// Filter by the filter type, or don't filter if StreamEntryAny
+func (b *Backend) GetEntryAfter(timestamp time.Time, filterType stream.StreamEntryType) (entry *stream.StreamEntry, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		entries, snapshots, err := b.buckets(tx)
+		if err != nil {
+			return err
+		}
+		bkt := entries
+		if filterType == stream.StreamEntrySnapshot {
+			bkt = snapshots
+		}
+		c := bkt.Cursor()
+		// Seek past every key at timestamp.
+		k, _ := c.Seek(encodeKey(timestamp, stream.StreamEntryAny))
+		for ; k != nil; k, _ = c.Next() {
+			if filterType == stream.StreamEntryAny || stream.StreamEntryType(k[8]) == filterType {
+				break
+			}
+		}
+		if k == nil {
+			return nil
+		}
+		entry, err = decodeEntry(k, entries.Get(k))
+		return err
+	})
+	return
+}
+
+// Get the entries after from and at or before to, in order.
+func (b *Backend) GetEntriesBetween(from, to time.Time, filterType stream.StreamEntryType, limit int) (res []*stream.StreamEntry, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		entries, snapshots, err := b.buckets(tx)
+		if err != nil {
+			return err
+		}
+		bkt := entries
+		if filterType == stream.StreamEntrySnapshot {
+			bkt = snapshots
+		}
+		end := encodeKey(to, stream.StreamEntryAny)
+		c := bkt.Cursor()
+		for k, _ := c.Seek(encodeKey(from, stream.StreamEntryAny)); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			if limit > 0 && len(res) >= limit {
+				break
+			}
+			if filterType != stream.StreamEntryAny && stream.StreamEntryType(k[8]) != filterType {
+				continue
+			}
+			entry, err := decodeEntry(k, entries.Get(k))
+			if err != nil {
+				return err
+			}
+			res = append(res, entry)
+		}
+		return nil
+	})
+	return
+}
+
+// Store a stream entry.
+func (b *Backend) SaveEntry(entry *stream.StreamEntry) error {
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		return b.putEntry(tx, entry)
+	})
+	if err != nil {
+		return err
+	}
+	b.notify(entry)
+	return nil
+}
+
+// Store the entries in one transaction. An entry replaces any entry at the same timestamp.
+func (b *Backend) SaveEntries(entries []*stream.StreamEntry) error {
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		for _, entry := range entries {
+			if _, err := b.deleteEntries(tx, entry.Timestamp); err != nil {
+				return err
+			}
+			if err := b.putEntry(tx, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		b.notify(entry)
+	}
+	return nil
+}
+
+func (b *Backend) notify(entry *stream.StreamEntry) {
+	b.subscribersMtx.RLock()
+	defer b.subscribersMtx.RUnlock()
+
+	for _, sub := range b.subscribers {
+		select {
+		case sub <- entry:
+		default:
+		}
+	}
+}
+
+func (b *Backend) putEntry(tx *bbolt.Tx, entry *stream.StreamEntry) error {
+	entries, snapshots, err := b.buckets(tx)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry.Data)
+	if err != nil {
+		return err
+	}
+	key := encodeKey(entry.Timestamp, entry.Type)
+	if err := entries.Put(key, data); err != nil {
+		return err
+	}
+	if entry.Type == stream.StreamEntrySnapshot {
+		return snapshots.Put(key, []byte{})
+	}
+	return nil
+}
+
+// Store the entry if the latest entry matches expectedHead, in one transaction.
+func (b *Backend) SaveEntryIfHead(entry *stream.StreamEntry, expectedHead *stream.StreamEntry) error {
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		if err := b.checkHead(tx, expectedHead); err != nil {
+			return err
+		}
+		return b.putEntry(tx, entry)
+	})
+	if err != nil {
+		return err
+	}
+	b.notify(entry)
+	return nil
+}
+
+// Replace the latest entry with entry if it matches expectedHead, in one transaction.
+func (b *Backend) AmendEntryIfHead(entry *stream.StreamEntry, expectedHead *stream.StreamEntry) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if err := b.checkHead(tx, expectedHead); err != nil {
+			return err
+		}
+		if expectedHead == nil {
+			return errors.New("Cannot amend the head of an empty stream.")
+		}
+		if _, err := b.deleteEntries(tx, expectedHead.Timestamp); err != nil {
+			return err
+		}
+		return b.putEntry(tx, entry)
+	})
+}
+
+// Check the latest entry matches expectedHead.
+func (b *Backend) checkHead(tx *bbolt.Tx, expectedHead *stream.StreamEntry) error {
+	entries, _, err := b.buckets(tx)
+	if err != nil {
+		return err
+	}
+	var head *stream.StreamEntry
+	if k, v := entries.Cursor().Last(); k != nil {
+		if head, err = decodeEntry(k, v); err != nil {
+			return err
+		}
+	}
+	return stream.CheckHead(head, expectedHead)
+}
+
+// Delete every entry at timestamp, returning if anything was deleted.
+func (b *Backend) deleteEntries(tx *bbolt.Tx, timestamp time.Time) (bool, error) {
+	entries, snapshots, err := b.buckets(tx)
+	if err != nil {
+		return false, err
+	}
+	prefix := encodeTimestamp(timestamp)
+	var keys [][]byte
+	c := entries.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	for _, k := range keys {
+		if err := entries.Delete(k); err != nil {
+			return false, err
+		}
+		if err := snapshots.Delete(k); err != nil {
+			return false, err
+		}
+	}
+	return len(keys) != 0, nil
+}
+
+// Amend an old entry
+func (b *Backend) AmendEntry(entry *stream.StreamEntry, oldTimestamp time.Time) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		found, err := b.deleteEntries(tx, oldTimestamp)
+		if err != nil || !found {
+			return err
+		}
+		return b.putEntry(tx, entry)
+	})
+}
+
+// Remove the entry at the timestamp
+func (b *Backend) RemoveEntry(timestamp time.Time) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		_, err := b.deleteEntries(tx, timestamp)
+		return err
+	})
+}
+
+func (b *Backend) EntryAdded(ch chan<- *stream.StreamEntry) {
+	if ch == nil {
+		return
+	}
+
+	b.subscribersMtx.Lock()
+	defer b.subscribersMtx.Unlock()
+
+	b.subscribers = append(b.subscribers, ch)
+}
+
+func (b *Backend) StopEntryAdded(ch chan<- *stream.StreamEntry) {
+	b.subscribersMtx.Lock()
+	defer b.subscribersMtx.Unlock()
+
+	for i, sub := range b.subscribers {
+		if sub == ch {
+			b.subscribers = append(b.subscribers[:i], b.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *Backend) ForEachEntry(cb func(entry *stream.StreamEntry) error) error {
+	return b.db.View(func(tx *bbolt.Tx) error {
+		entries, _, err := b.buckets(tx)
+		if err != nil {
+			return err
+		}
+		return entries.ForEach(func(k, v []byte) error {
+			entry, err := decodeEntry(k, v)
+			if err != nil {
+				return err
+			}
+			return cb(entry)
+		})
+	})
+}
+
+// A multi-stream backend over a bbolt database, for use with stream.StreamStore.
+type MultiBackend struct {
+	db *bbolt.DB
+}
+
+func NewMultiBackend(db *bbolt.DB) *MultiBackend {
+	return &MultiBackend{db: db}
+}
+
+// Open the stream with the ID, creating its bucket if needed.
+func (m *MultiBackend) OpenStream(streamId string) (stream.StorageBackend, error) {
+	return NewBackend(m.db, streamId)
+}
+
+// List the IDs of every stream in the database.
+func (m *MultiBackend) ListStreams() ([]string, error) {
+	return ListStreams(m.db)
+}
+
+// Delete the stream with the ID from the database.
+func (m *MultiBackend) DeleteStream(streamId string) error {
+	return DeleteStream(m.db, streamId)
+}
+
+// List the IDs of every stream in db.
+func ListStreams(db *bbolt.DB) ([]string, error) {
+	var ids []string
+	err := db.View(func(tx *bbolt.Tx) error {
+		root := tx.Bucket(streamsBucket)
+		if root == nil {
+			return nil
+		}
+		return root.ForEach(func(name, value []byte) error {
+			// Only nested buckets have a nil value.
+			if value == nil {
+				ids = append(ids, string(name))
+			}
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// Delete the stream with the ID from db.
+func DeleteStream(db *bbolt.DB, streamId string) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		root := tx.Bucket(streamsBucket)
+		if root == nil {
+			return nil
+		}
+		err := root.DeleteBucket([]byte(streamId))
+		if err == bbolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
@@ -0,0 +1,191 @@
+package bolt
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fuserobotics/statestream"
+	"github.com/fuserobotics/statestream/storagetest"
+	bbolt "go.etcd.io/bbolt"
+)
+
+func openTestDb(t *testing.T) *bbolt.DB {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "streams.db"), 0644, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return db
+}
+
+func TestBackendLookups(t *testing.T) {
+	db := openTestDb(t)
+	defer db.Close()
+
+	b, err := NewBackend(db, "test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		typ := stream.StreamEntryMutation
+		if i%5 == 0 {
+			typ = stream.StreamEntrySnapshot
+		}
+		err := b.SaveEntry(&stream.StreamEntry{
+			Type:      typ,
+			Timestamp: now.Add(time.Duration(i) * time.Second),
+			Data:      stream.StateData{"test": i},
+		})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	snap, err := b.GetSnapshotBefore(now.Add(time.Duration(5) * time.Second))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if snap == nil || snap.Data["test"].(float64) != 0 {
+		t.Fatalf("Unexpected snapshot before: %v", snap)
+	}
+	next, err := b.GetEntryAfter(now, stream.StreamEntrySnapshot)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if next == nil || next.Data["test"].(float64) != 5 || !next.Timestamp.Equal(now.Add(time.Duration(5)*time.Second)) {
+		t.Fatalf("Unexpected snapshot after: %v", next)
+	}
+	next, err = b.GetEntryAfter(now, stream.StreamEntryAny)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if next == nil || next.Data["test"].(float64) != 1 {
+		t.Fatalf("Unexpected entry after: %v", next)
+	}
+
+	amended := &stream.StreamEntry{
+		Type:      stream.StreamEntryMutation,
+		Timestamp: next.Timestamp,
+		Data:      stream.StateData{"test": "amended"},
+	}
+	if err := b.AmendEntry(amended, next.Timestamp); err != nil {
+		t.Fatalf(err.Error())
+	}
+	next, err = b.GetEntryAfter(now, stream.StreamEntryAny)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if next == nil || next.Data["test"] != "amended" {
+		t.Fatalf("Entry was not amended: %v", next)
+	}
+}
+
+func TestSharedDatabase(t *testing.T) {
+	db := openTestDb(t)
+	defer db.Close()
+
+	// A bucket of the application sharing the database.
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("app"))
+		return err
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	now := time.Now()
+	for _, id := range []string{"a", "b"} {
+		b, err := NewBackend(db, id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		strm, err := stream.NewStream(b, nil)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err := strm.WriteState(now, stream.StateData{"id": id}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	b, err := NewBackend(db, "b")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	strm, _ := stream.NewStream(b, nil)
+	cursor := strm.BuildCursor(stream.ReadForwardCursor)
+	if err := cursor.Init(now.Add(time.Second)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if state, _ := cursor.State(); state["id"] != "b" {
+		t.Fatalf("Unexpected state %v.", state)
+	}
+
+	if err := DeleteStream(db, "a"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	ids, err := ListStreams(db)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(ids) != 1 || ids[0] != "b" {
+		t.Fatalf("Unexpected streams %v.", ids)
+	}
+
+	if err := DeleteStream(db, "app"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte("app")) == nil {
+			return errors.New("Deleting a stream removed an application bucket.")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+func TestStreamStore(t *testing.T) {
+	db := openTestDb(t)
+	defer db.Close()
+
+	store, err := stream.NewStreamStore(NewMultiBackend(db), nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	strm, err := store.GetStream("device-1")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := strm.WriteState(time.Now(), stream.StateData{"test": 1}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	ids, err := store.ListStreams()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(ids) != 1 || ids[0] != "device-1" {
+		t.Fatalf("Unexpected streams %v.", ids)
+	}
+	if err := store.DeleteStream("device-1"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ids, _ := store.ListStreams(); len(ids) != 0 {
+		t.Fatalf("Unexpected streams after delete %v.", ids)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) stream.StorageBackend {
+		db := openTestDb(t)
+		t.Cleanup(func() { db.Close() })
+		b, err := NewBackend(db, "test")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		return b
+	})
+}
@@ -11,6 +11,8 @@ It is generated from these files:
 It has these top-level messages:
 	Config
 	RateConfig
+	RetentionConfig
+	RetentionTier
 */
 package stream
 
@@ -30,7 +32,8 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
 type Config struct {
-	RecordRate *RateConfig `protobuf:"bytes,1,opt,name=record_rate,json=recordRate" json:"record_rate,omitempty"`
+	RecordRate *RateConfig      `protobuf:"bytes,1,opt,name=record_rate,json=recordRate" json:"record_rate,omitempty"`
+	Retention  *RetentionConfig `protobuf:"bytes,2,opt,name=retention" json:"retention,omitempty"`
 }
 
 func (m *Config) Reset()                    { *m = Config{} }
@@ -45,6 +48,13 @@ func (m *Config) GetRecordRate() *RateConfig {
 	return nil
 }
 
+func (m *Config) GetRetention() *RetentionConfig {
+	if m != nil {
+		return m.Retention
+	}
+	return nil
+}
+
 type RateConfig struct {
 	// Minimum time between keyframes in milliseconds
 	KeyframeFrequency int64 `protobuf:"varint,1,opt,name=keyframe_frequency,json=keyframeFrequency" json:"keyframe_frequency,omitempty"`
@@ -57,25 +67,74 @@ func (m *RateConfig) String() string            { return proto.CompactTextString
 func (*RateConfig) ProtoMessage()               {}
 func (*RateConfig) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
 
+type RetentionConfig struct {
+	// Tiers applied to progressively older data, ordered by min_age
+	Tiers []*RetentionTier `protobuf:"bytes,1,rep,name=tiers" json:"tiers,omitempty"`
+	// Delete entries older than this in milliseconds, 0 to keep forever
+	MaxAge int64 `protobuf:"varint,2,opt,name=max_age,json=maxAge" json:"max_age,omitempty"`
+}
+
+func (m *RetentionConfig) Reset()                    { *m = RetentionConfig{} }
+func (m *RetentionConfig) String() string            { return proto.CompactTextString(m) }
+func (*RetentionConfig) ProtoMessage()               {}
+func (*RetentionConfig) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+func (m *RetentionConfig) GetTiers() []*RetentionTier {
+	if m != nil {
+		return m.Tiers
+	}
+	return nil
+}
+
+type RetentionTier struct {
+	// Apply this tier to entries older than this in milliseconds
+	MinAge int64 `protobuf:"varint,1,opt,name=min_age,json=minAge" json:"min_age,omitempty"`
+	// Rate to re-structure entries in this tier with
+	RecordRate *RateConfig `protobuf:"bytes,2,opt,name=record_rate,json=recordRate" json:"record_rate,omitempty"`
+	// Drop mutations, keeping one snapshot per keyframe period
+	SnapshotsOnly bool `protobuf:"varint,3,opt,name=snapshots_only,json=snapshotsOnly" json:"snapshots_only,omitempty"`
+}
+
+func (m *RetentionTier) Reset()                    { *m = RetentionTier{} }
+func (m *RetentionTier) String() string            { return proto.CompactTextString(m) }
+func (*RetentionTier) ProtoMessage()               {}
+func (*RetentionTier) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *RetentionTier) GetRecordRate() *RateConfig {
+	if m != nil {
+		return m.RecordRate
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Config)(nil), "stream.Config")
 	proto.RegisterType((*RateConfig)(nil), "stream.RateConfig")
+	proto.RegisterType((*RetentionConfig)(nil), "stream.RetentionConfig")
+	proto.RegisterType((*RetentionTier)(nil), "stream.RetentionTier")
 }
 
 func init() { proto.RegisterFile("github.com/fuserobotics/statestream/config.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 180 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x4c, 0xce, 0xb1, 0x8e, 0x82, 0x40,
-	0x10, 0xc6, 0xf1, 0x70, 0x97, 0x50, 0x0c, 0xc5, 0x9d, 0x5b, 0x59, 0x1a, 0x2a, 0x2d, 0x5c, 0x8c,
-	0xd4, 0x56, 0x26, 0x3e, 0x00, 0x2f, 0x40, 0x96, 0x75, 0x16, 0x88, 0x81, 0xd1, 0xd9, 0xa1, 0xe0,
-	0xed, 0x8d, 0xbb, 0x41, 0x6d, 0xff, 0xdf, 0x2f, 0x93, 0x81, 0x43, 0xdb, 0x4b, 0x37, 0x35, 0xda,
-	0xd2, 0x50, 0xb8, 0xc9, 0x23, 0x53, 0x43, 0xd2, 0x5b, 0x5f, 0x78, 0x31, 0x82, 0x5e, 0x18, 0xcd,
-	0x50, 0x58, 0x1a, 0x5d, 0xdf, 0xea, 0x3b, 0x93, 0x90, 0x4a, 0x63, 0xcc, 0x4f, 0x90, 0x9e, 0x43,
-	0x57, 0x25, 0x64, 0x8c, 0x96, 0xf8, 0x5a, 0xb3, 0x11, 0x5c, 0x27, 0x9b, 0x64, 0x9b, 0x1d, 0x95,
-	0x8e, 0x4e, 0x57, 0x46, 0x30, 0xc2, 0x0a, 0x22, 0x7b, 0x95, 0xdc, 0x01, 0x7c, 0x16, 0xb5, 0x07,
-	0x75, 0xc3, 0xd9, 0xb1, 0x19, 0xb0, 0x76, 0x8c, 0x8f, 0x09, 0x47, 0x3b, 0x87, 0x4b, 0xbf, 0xd5,
-	0x6a, 0x59, 0x2e, 0xcb, 0xa0, 0x76, 0xf0, 0x6f, 0x3b, 0x33, 0xb6, 0xdf, 0xf8, 0x27, 0xe0, 0xbf,
-	0xd8, 0xdf, 0xb4, 0x49, 0xc3, 0xd7, 0xe5, 0x33, 0x00, 0x00, 0xff, 0xff, 0xe1, 0x92, 0xcb, 0x98,
-	0xe9, 0x00, 0x00, 0x00,
+	// 297 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x8c, 0xd1, 0x51, 0x4b, 0xf3, 0x30,
+	0x14, 0x06, 0x60, 0xb2, 0xf1, 0xf5, 0xd3, 0x33, 0xe6, 0x34, 0x20, 0xeb, 0xe5, 0x28, 0x08, 0x13,
+	0xb1, 0x93, 0x0d, 0x7f, 0xc0, 0x10, 0xbc, 0x15, 0x8a, 0xe0, 0x65, 0xc9, 0xe2, 0x69, 0x16, 0x5c,
+	0x93, 0x99, 0x9c, 0xc1, 0x7a, 0xef, 0x0f, 0x17, 0x93, 0xad, 0xd3, 0x79, 0xe3, 0xed, 0x7b, 0x9e,
+	0xb7, 0x3d, 0x9c, 0xc0, 0x9d, 0xd2, 0xb4, 0xdc, 0x2c, 0x72, 0x69, 0xeb, 0x49, 0xb5, 0xf1, 0xe8,
+	0xec, 0xc2, 0x92, 0x96, 0x7e, 0xe2, 0x49, 0x10, 0x7a, 0x72, 0x28, 0xea, 0x89, 0xb4, 0xa6, 0xd2,
+	0x2a, 0x5f, 0x3b, 0x4b, 0x96, 0x27, 0x31, 0xcc, 0x08, 0x92, 0x87, 0x90, 0xf3, 0x19, 0xf4, 0x1c,
+	0x4a, 0xeb, 0x5e, 0x4b, 0x27, 0x08, 0x53, 0x36, 0x62, 0xe3, 0xde, 0x94, 0xe7, 0xd1, 0xe5, 0x85,
+	0x20, 0x8c, 0xb0, 0x80, 0xc8, 0xbe, 0x12, 0x7e, 0x0f, 0xa7, 0x0e, 0x09, 0x0d, 0x69, 0x6b, 0xd2,
+	0x4e, 0xa8, 0x0c, 0xdb, 0xca, 0x7e, 0xb0, 0xeb, 0x1d, 0x64, 0x56, 0x01, 0x1c, 0x3e, 0xc8, 0x6f,
+	0x81, 0xbf, 0x61, 0x53, 0x39, 0x51, 0x63, 0x59, 0x39, 0x7c, 0xdf, 0xa0, 0x91, 0x4d, 0x58, 0xa0,
+	0x5b, 0x5c, 0xec, 0x27, 0x8f, 0xfb, 0x01, 0xbf, 0x86, 0x73, 0xb9, 0x14, 0x46, 0x7d, 0xc7, 0x9d,
+	0x80, 0x07, 0x31, 0x6f, 0x69, 0xf6, 0x02, 0x83, 0xa3, 0x2d, 0xf8, 0x0d, 0xfc, 0x23, 0x8d, 0xce,
+	0xa7, 0x6c, 0xd4, 0x1d, 0xf7, 0xa6, 0x97, 0xbf, 0xb6, 0x7d, 0xd6, 0xe8, 0x8a, 0x68, 0xf8, 0x10,
+	0xfe, 0xd7, 0x62, 0x5b, 0x0a, 0x85, 0xbb, 0x3f, 0x24, 0xb5, 0xd8, 0xce, 0x15, 0x66, 0x1f, 0x0c,
+	0xfa, 0x3f, 0x1a, 0x81, 0x6a, 0x13, 0x28, 0xdb, 0x51, 0x6d, 0xe6, 0x0a, 0x8f, 0xef, 0xda, 0xf9,
+	0xd3, 0x5d, 0xaf, 0xe0, 0xcc, 0x1b, 0xb1, 0xf6, 0x4b, 0x4b, 0xbe, 0xb4, 0x66, 0xd5, 0xa4, 0xdd,
+	0x11, 0x1b, 0x9f, 0x14, 0xfd, 0x36, 0x7d, 0x32, 0xab, 0x66, 0x91, 0x84, 0xc7, 0x9c, 0x7d, 0x0e,
+	0x00, 0xfb, 0x7c, 0x72, 0xd8, 0x00, 0x02, 0x00, 0x00,
 }
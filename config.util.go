@@ -10,6 +10,11 @@ func (c *Config) Validate() error {
 	if err := c.RecordRate.Validate(); err != nil {
 		return err
 	}
+	if c.Retention != nil {
+		if err := c.Retention.Validate(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -19,3 +24,33 @@ func (c *RateConfig) Validate() error {
 	}
 	return nil
 }
+
+func (c *RetentionConfig) Validate() error {
+	var lastAge int64
+	for _, tier := range c.Tiers {
+		if tier == nil {
+			return errors.New("Retention tiers must be defined.")
+		}
+		if err := tier.Validate(); err != nil {
+			return err
+		}
+		if tier.MinAge <= lastAge {
+			return errors.New("Retention tiers must be ordered by increasing age.")
+		}
+		lastAge = tier.MinAge
+	}
+	if c.MaxAge < 0 || (c.MaxAge != 0 && c.MaxAge <= lastAge) {
+		return errors.New("Retention max age must be 0 or older than every tier.")
+	}
+	return nil
+}
+
+func (c *RetentionTier) Validate() error {
+	if c.MinAge <= 0 {
+		return errors.New("Retention tier age must be > 0.")
+	}
+	if c.RecordRate == nil {
+		return errors.New("Retention tier rate must be defined.")
+	}
+	return c.RecordRate.Validate()
+}
@@ -1,6 +1,7 @@
 package stream
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"sync"
@@ -20,6 +21,15 @@ const (
 
 var NoDataError error = errors.New("No data for that timestamp.")
 
+// Returned when writing an entry before the latest entry of the stream.
+var LateEntryError error = errors.New("Entry is before the latest entry, we can't handle this.")
+
+// Latest representable timestamp, used to position cursors at the head of a stream.
+var endOfTime = time.Unix(0, 1<<63-1)
+
+// Number of entries to request per query when fast-forwarding with a RangeStorageBackend.
+const fastForwardBatchSize = 100
+
 // A cursor at a given point
 type Cursor struct {
 	storage StorageBackend
@@ -63,16 +73,23 @@ type Cursor struct {
 	// Last state before lastMutation
 	lastState *StateDataPtr
 
+	// Keep lastMutation and lastState on a read cursor too, so an amended
+	// last entry can be re-applied without a replay.
+	keepLastState bool
+
 	// Possibly known rate config
 	rateConfig *RateConfig
 
 	// For a feed-forward cursor, subscribe to a stream of entries when fast-forwarding
 	// This is useful to get all entries between two points, e.x.:
 	// cursor.Init(oldTime); sub := cursor.WatchEntries(func(entry *StreamEntry){}); cursor.SetTimestamp(newTime); cursor.Compute(); sub.Unsubscribe()
-	entrySubscriptions map[int]chan<- *StreamEntry
+	entrySubscriptions map[int]*cursorEntrySubscription
 
 	// Running nonce for subscription IDs
 	entrySubscriptionsNonce int
+
+	// Entries applied and states recomputed while computing, sent to subscribers after unlocking.
+	pendingSends []*pendingSend
 }
 
 func newCursor(storage StorageBackend, cursorType CursorType) *Cursor {
@@ -80,7 +97,7 @@ func newCursor(storage StorageBackend, cursorType CursorType) *Cursor {
 		storage:            storage,
 		cursorType:         cursorType,
 		computeMutex:       sync.Mutex{},
-		entrySubscriptions: make(map[int]chan<- *StreamEntry),
+		entrySubscriptions: make(map[int]*cursorEntrySubscription),
 		ready:              false,
 		lastMutations:      make([]*StreamEntry, 0),
 	}
@@ -89,6 +106,11 @@ func newCursor(storage StorageBackend, cursorType CursorType) *Cursor {
 // Initializes a cursor at a timestamp.
 // Timestamp is optional for a write cursor.
 func (c *Cursor) Init(timestamp time.Time) error {
+	return c.InitContext(context.Background(), timestamp)
+}
+
+// Initializes a cursor at a timestamp, with a context for the storage queries.
+func (c *Cursor) InitContext(ctx context.Context, timestamp time.Time) error {
 	if c.inited {
 		return errors.New("Do not call Init() twice.")
 	}
@@ -100,7 +122,7 @@ func (c *Cursor) Init(timestamp time.Time) error {
 	} else {
 		c.SetTimestamp(timestamp)
 	}
-	return c.ComputeState()
+	return c.ComputeStateContext(ctx)
 }
 
 func (c *Cursor) InitWithSnapshot(snap *StreamEntry) error {
@@ -115,7 +137,7 @@ func (c *Cursor) InitWithSnapshot(snap *StreamEntry) error {
 	if err := c.copySnapshotState(); err != nil {
 		return err
 	}
-	c.fillNextSnapshot()
+	c.fillNextSnapshot(context.Background())
 	return nil
 }
 
@@ -138,20 +160,90 @@ func (c *Cursor) State() (StateData, error) {
 	return c.computedState.StateData, nil
 }
 
+// Subscribe to entries as the cursor applies or writes them.
+// Sends block until the subscriber receives the entry, without holding the cursor lock.
 func (c *Cursor) SubscribeEntries(ch chan<- *StreamEntry) CursorEntrySubscription {
+	return c.subscribeEntries(&cursorEntrySubscription{ch: reflect.ValueOf(ch)})
+}
+
+// Subscribe to entries with an overflow policy for when ch is full.
+func (c *Cursor) SubscribeEntriesWithOptions(ch chan *StreamEntry, options *SubscriptionOptions) (CursorEntrySubscription, error) {
+	if options == nil {
+		options = &SubscriptionOptions{}
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	return c.subscribeEntries(&cursorEntrySubscription{
+		ch:      reflect.ValueOf(ch),
+		options: *options,
+	}), nil
+}
+
+func (c *Cursor) subscribeEntries(sub *cursorEntrySubscription) CursorEntrySubscription {
 	c.computeMutex.Lock()
 	defer c.computeMutex.Unlock()
+	return c.addEntrySubscription(sub)
+}
 
+// Note: Lock computeMutex before calling
+func (c *Cursor) addEntrySubscription(sub *cursorEntrySubscription) CursorEntrySubscription {
 	nonce := c.entrySubscriptionsNonce
 	c.entrySubscriptionsNonce++
-	c.entrySubscriptions[nonce] = ch
-	return &cursorEntrySubscription{
-		unsubFunc: func() {
-			c.computeMutex.Lock()
-			defer c.computeMutex.Unlock()
-			delete(c.entrySubscriptions, nonce)
-		},
+	c.entrySubscriptions[nonce] = sub
+	sub.done = make(chan struct{})
+	sub.unsubFunc = func() {
+		c.computeMutex.Lock()
+		defer c.computeMutex.Unlock()
+		delete(c.entrySubscriptions, nonce)
+	}
+	return sub
+}
+
+// Get the current subscriptions, to send to after unlocking.
+// Note: Lock computeMutex before calling
+func (c *Cursor) entrySubscribers() []*cursorEntrySubscription {
+	subs := make([]*cursorEntrySubscription, 0, len(c.entrySubscriptions))
+	for _, sub := range c.entrySubscriptions {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// Unlock computeMutex, then send the entries applied and states recomputed while computing.
+// Note: Lock computeMutex before calling
+func (c *Cursor) unlockAndSend() {
+	subs := c.entrySubscribers()
+	pending := c.pendingSends
+	c.pendingSends = nil
+	c.computeMutex.Unlock()
+
+	for _, p := range pending {
+		if p.entry != nil {
+			sendEntry(subs, p.entry)
+			continue
+		}
+		for _, sub := range subs {
+			sub.resetState(p.state)
+		}
+	}
+}
+
+// Queue the recomputed state for subscriptions tracking the state.
+// Note: Lock computeMutex before calling
+func (c *Cursor) queueReset() error {
+	for _, sub := range c.entrySubscriptions {
+		if sub.reset == nil {
+			continue
+		}
+		state, err := c.computedState.Clone()
+		if err != nil {
+			return err
+		}
+		c.pendingSends = append(c.pendingSends, &pendingSend{state: state.StateData})
+		return nil
 	}
+	return nil
 }
 
 func (c *Cursor) SetTimestamp(timestamp time.Time) {
@@ -220,8 +312,8 @@ func (c *Cursor) Ready() bool {
 }
 
 // Finds the last snapshot field.
-func (c *Cursor) fillLastSnapshot() error {
-	data, err := c.storage.GetSnapshotBefore(c.timestamp)
+func (c *Cursor) fillLastSnapshot(ctx context.Context) error {
+	data, err := WithContext(c.storage).GetSnapshotBeforeContext(ctx, c.timestamp)
 	if err != nil {
 		return err
 	}
@@ -244,7 +336,7 @@ func (c *Cursor) fillLastSnapshot() error {
 	return nil
 }
 
-func (c *Cursor) fillNextSnapshot() error {
+func (c *Cursor) fillNextSnapshot(ctx context.Context) error {
 	// If we don't have a last snapshot, we can't have a next one.
 	if c.lastSnapshot == nil {
 		c.nextSnapshot = nil
@@ -263,7 +355,7 @@ func (c *Cursor) fillNextSnapshot() error {
 	}
 
 	// Do the db hit
-	snap, err := c.storage.GetEntryAfter(c.lastSnapshot.Timestamp, StreamEntrySnapshot)
+	snap, err := WithContext(c.storage).GetEntryAfterContext(ctx, c.lastSnapshot.Timestamp, StreamEntrySnapshot)
 	if err != nil {
 		return err
 	}
@@ -315,14 +407,14 @@ func (c *Cursor) rewindState() (err error) {
 		return nil
 	}
 
-	if c.lastMutations[idx].Timestamp.Before(c.timestamp) {
+	if !c.lastMutations[idx].Timestamp.After(c.timestamp) {
 		// we don't have to do anything
 		return nil
 	}
 
-	// Apply mutations backwards until next mutation is before target.
+	// Apply mutations backwards until next mutation is at or before target.
 	// Our checks above guerantee this has a base case, and idx will never be < 0.
-	for !c.lastMutations[idx].Timestamp.Before(c.timestamp) {
+	for c.lastMutations[idx].Timestamp.After(c.timestamp) {
 		mutation := c.lastMutations[idx]
 		newObj, err := mutate.ApplyMutationObject(c.computedState.StateData, mutation.Data)
 		// If this happens it's a bug in mutate
@@ -332,13 +424,14 @@ func (c *Cursor) rewindState() (err error) {
 		c.computedState.StateData = newObj
 		idx--
 	}
+	c.computedTimestamp = c.lastMutations[idx].Timestamp
 
 	return nil
 }
 
 func (c *Cursor) applyMutation(mutation *StreamEntry) (err error) {
 	var beforeObj *StateDataPtr
-	if c.cursorType == ReadBidirectionalCursor || c.cursorType == WriteCursor {
+	if c.cursorType == ReadBidirectionalCursor || c.cursorType == WriteCursor || c.keepLastState {
 		var err error
 		beforeObj, err = c.computedState.Clone()
 		if err != nil {
@@ -359,7 +452,7 @@ func (c *Cursor) applyMutation(mutation *StreamEntry) (err error) {
 			Data:      mutate.BuildMutation(stateAfter, beforeData.(map[string]interface{})),
 			Timestamp: mutation.Timestamp,
 		})
-	} else if c.cursorType == WriteCursor {
+	} else if c.cursorType == WriteCursor || c.keepLastState {
 		c.lastMutation = mutation
 		c.lastState = beforeObj
 	}
@@ -373,7 +466,7 @@ func (c *Cursor) applyMutation(mutation *StreamEntry) (err error) {
 // Assumptions:
 //  - the lastSnapshot is filled and BEFORE target timestamp
 //  - there is an old state set (computedState) at computedTimestamp
-func (c *Cursor) fastForwardState() (err error) {
+func (c *Cursor) fastForwardState(ctx context.Context) (err error) {
 	defer func() {
 		if err != nil {
 			c.computedState = nil
@@ -383,8 +476,13 @@ func (c *Cursor) fastForwardState() (err error) {
 		//}
 	}()
 
+	if _, ok := c.storage.(RangeStorageBackend); ok {
+		return c.fastForwardRange(ctx)
+	}
+
+	storage := WithContext(c.storage)
 	for c.computedTimestamp.Before(c.timestamp) {
-		entry, err := c.storage.GetEntryAfter(c.computedTimestamp, StreamEntryAny)
+		entry, err := storage.GetEntryAfterContext(ctx, c.computedTimestamp, StreamEntryAny)
 		if err != nil {
 			return err
 		}
@@ -400,25 +498,58 @@ func (c *Cursor) fastForwardState() (err error) {
 			}
 			break
 		}
-		for _, cb := range c.entrySubscriptions {
-			cb <- entry
+		if err := c.fastForwardEntry(ctx, entry); err != nil {
+			return err
 		}
-		if entry.Type == StreamEntryMutation {
-			if err := c.applyMutation(entry); err != nil {
-				return err
-			}
-		} else if entry.Type == StreamEntrySnapshot {
-			c.lastSnapshot = entry
-			c.nextSnapshot = nil
-			if err := c.copySnapshotState(); err != nil {
-				return err
+	}
+
+	return nil
+}
+
+// Fast-forwards the state, fetching a batch of entries per query.
+func (c *Cursor) fastForwardRange(ctx context.Context) error {
+	for c.computedTimestamp.Before(c.timestamp) {
+		entries, _, err := getEntriesBetweenContext(ctx, c.storage, c.computedTimestamp, c.timestamp, StreamEntryAny, fastForwardBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.Timestamp.After(c.computedTimestamp) || entry.Timestamp.After(c.timestamp) {
+				return errors.New("Storage backend returned an entry outside the requested range.")
 			}
-			if err := c.fillNextSnapshot(); err != nil {
+			if err := c.fastForwardEntry(ctx, entry); err != nil {
 				return err
 			}
 		}
+		if len(entries) < fastForwardBatchSize {
+			break
+		}
 	}
+	return nil
+}
 
+// Apply an entry while fast-forwarding.
+func (c *Cursor) fastForwardEntry(ctx context.Context, entry *StreamEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(c.entrySubscriptions) > 0 {
+		c.pendingSends = append(c.pendingSends, &pendingSend{entry: entry})
+	}
+	if entry.Type == StreamEntryMutation {
+		if err := c.applyMutation(entry); err != nil {
+			return err
+		}
+	} else if entry.Type == StreamEntrySnapshot {
+		c.lastSnapshot = entry
+		c.nextSnapshot = nil
+		if err := c.copySnapshotState(); err != nil {
+			return err
+		}
+		if err := c.fillNextSnapshot(ctx); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -458,7 +589,7 @@ func (c *Cursor) canHandleNewEntry(timestamp time.Time) error {
 	}
 	// We can't really do anything in this situation
 	if c.lastState != nil && timestamp.Before(c.computedTimestamp) {
-		return errors.New("Entry is before the latest entry, we can't handle this.")
+		return LateEntryError
 	}
 	return nil
 }
@@ -466,13 +597,12 @@ func (c *Cursor) canHandleNewEntry(timestamp time.Time) error {
 // Handle a state entry on a writer (keeps writer up to date)
 func (c *Cursor) HandleEntry(entry *StreamEntry) (handleError error) {
 	c.computeMutex.Lock()
+	subs := c.entrySubscribers()
 	defer func() {
 		if handleError != nil {
 			return
 		}
-		for _, cb := range c.entrySubscriptions {
-			cb <- entry
-		}
+		sendEntry(subs, entry)
 	}()
 	defer c.computeMutex.Unlock()
 
@@ -488,8 +618,13 @@ func (c *Cursor) HandleEntry(entry *StreamEntry) (handleError error) {
 }
 
 func (c *Cursor) WriteEntry(entry *StreamEntry, config *RateConfig) (writeError error) {
+	return c.WriteEntryContext(context.Background(), entry, config)
+}
+
+// Writes an entry to the end of the stream, with a context for the storage calls.
+func (c *Cursor) WriteEntryContext(ctx context.Context, entry *StreamEntry, config *RateConfig) (writeError error) {
 	if entry.Type == StreamEntrySnapshot {
-		return c.WriteState(entry.Timestamp, entry.Data, config)
+		return c.WriteStateContext(ctx, entry.Timestamp, entry.Data, config)
 	}
 
 	// Apply the mutation
@@ -509,29 +644,39 @@ func (c *Cursor) WriteEntry(entry *StreamEntry, config *RateConfig) (writeError
 		return err
 	}
 
-	return c.WriteState(entry.Timestamp, nsd, config)
+	return c.WriteStateContext(ctx, entry.Timestamp, nsd, config)
 }
 
 // Writes a state to the end of the stream.
 func (c *Cursor) WriteState(timestamp time.Time, state StateData, config *RateConfig) (writeError error) {
+	return c.WriteStateContext(context.Background(), timestamp, state, config)
+}
+
+// Writes a state to the end of the stream, with a context for the storage calls.
+func (c *Cursor) WriteStateContext(ctx context.Context, timestamp time.Time, state StateData, config *RateConfig) (writeError error) {
 	c.computeMutex.Lock()
-	var savedEntry *StreamEntry
-	defer func() {
-		if writeError == nil && savedEntry != nil {
-			c.computedTimestamp = savedEntry.Timestamp
-			for _, ch := range c.entrySubscriptions {
-				ch <- savedEntry
-			}
-		}
-	}()
-	defer c.computeMutex.Unlock()
+	subs := c.entrySubscribers()
+	savedEntry, writeError := c.writeState(ctx, WithContext(c.storage), timestamp, state, config)
+	if writeError == nil && savedEntry != nil {
+		c.computedTimestamp = savedEntry.Timestamp
+	}
+	c.computeMutex.Unlock()
 
+	if writeError == nil && savedEntry != nil {
+		sendEntry(subs, savedEntry)
+	}
+	return writeError
+}
+
+// Writes a state to storage, returning the entry to send to subscribers.
+// Note: Lock computeMutex before calling
+func (c *Cursor) writeState(ctx context.Context, storage ContextStorageBackend, timestamp time.Time, state StateData, config *RateConfig) (*StreamEntry, error) {
 	if c.lastState != nil && reflect.DeepEqual(c.lastState.StateData, state) {
-		return nil
+		return nil, nil
 	}
 
 	if err := c.canHandleNewEntry(timestamp); err != nil {
-		return err
+		return nil, err
 	}
 
 	inputState := CloneStateData(state)
@@ -545,9 +690,11 @@ func (c *Cursor) WriteState(timestamp time.Time, state StateData, config *RateCo
 		lastChange = c.lastMutation.Timestamp
 	}
 	if c.lastState != nil && timestamp.Before(lastChange) {
-		return errors.New("Cannot write entry before last change.")
+		return nil, errors.New("Cannot write entry before last change.")
 	}
 
+	var savedEntry *StreamEntry
+
 	// If the last thing that changed was a mutation and it's too soon to make a new mutation
 	if c.lastMutation != nil && timestamp.Sub(c.lastMutation.Timestamp) < (time.Duration(config.ChangeFrequency)*time.Millisecond) {
 		amendedMutation := &StreamEntry{
@@ -555,29 +702,29 @@ func (c *Cursor) WriteState(timestamp time.Time, state StateData, config *RateCo
 			Timestamp: c.lastMutation.Timestamp,
 		}
 
-		// Calculate a mutation from lastMutation to the new state.
+		// Calculate a mutation from the state at lastMutation to the new state.
 		if c.lastState != nil && len(c.entrySubscriptions) > 0 {
 			savedEntry = &StreamEntry{
 				Type:      StreamEntryMutation,
 				Timestamp: timestamp,
 			}
-			dupedLastState, err := c.lastState.Clone()
+			dupedComputedState, err := c.computedState.Clone()
 			if err == nil {
-				savedEntry.Data = mutate.BuildMutation(dupedLastState.StateData, inputState.StateData)
+				savedEntry.Data = mutate.BuildMutation(dupedComputedState.StateData, inputState.StateData)
 			}
 		}
 
 		// Calculate the new mutation
 		amendedMutation.Data = mutate.BuildMutation(c.lastState.StateData, inputState.StateData)
-		if err := c.storage.AmendEntry(amendedMutation, c.lastMutation.Timestamp); err != nil {
-			return err
+		if err := storage.AmendEntryContext(ctx, amendedMutation, c.lastMutation.Timestamp); err != nil {
+			return savedEntry, err
 		}
 
 		// Apply the new state
 		c.computedState = inputState
 		c.computedTimestamp = timestamp
 		c.lastMutation = amendedMutation
-		return nil
+		return savedEntry, nil
 	}
 
 	// Check if we should make a new snapshot
@@ -590,8 +737,8 @@ func (c *Cursor) WriteState(timestamp time.Time, state StateData, config *RateCo
 		}
 
 		savedEntry = snapshot
-		if err := c.storage.SaveEntry(snapshot); err != nil {
-			return err
+		if err := storage.SaveEntryContext(ctx, snapshot); err != nil {
+			return savedEntry, err
 		}
 
 		c.lastSnapshot = snapshot
@@ -599,39 +746,48 @@ func (c *Cursor) WriteState(timestamp time.Time, state StateData, config *RateCo
 		if err := c.copySnapshotState(); err != nil {
 			c.ready = false
 			c.computedState = nil
-			return err
+			return savedEntry, err
 		}
-		return nil
+		return savedEntry, nil
 	}
 
-	// Make a new mutation
+	// Make a new mutation from the current state.
+	// computedState is replaced by inputState, so the mutation may modify it.
 	oldState, err := c.computedState.Clone()
 	if err != nil {
-		return err
+		return savedEntry, err
 	}
 
 	newMutationEntry := &StreamEntry{
 		Type:      StreamEntryMutation,
 		Timestamp: timestamp,
-		Data:      mutate.BuildMutation(c.lastState.StateData, inputState.StateData),
+		Data:      mutate.BuildMutation(c.computedState.StateData, inputState.StateData),
 	}
 
 	savedEntry = newMutationEntry
-	if err := c.storage.SaveEntry(newMutationEntry); err != nil {
-		return err
+	if err := storage.SaveEntryContext(ctx, newMutationEntry); err != nil {
+		c.ready = false
+		c.computedState = nil
+		return savedEntry, err
 	}
 
 	c.lastMutation = newMutationEntry
 	c.lastState = oldState
 	c.computedState = inputState
 	c.computedTimestamp = timestamp
-	return nil
+	return savedEntry, nil
 }
 
 // Make a cursor become ready, or return the error
 func (c *Cursor) ComputeState() (computeErr error) {
+	return c.ComputeStateContext(context.Background())
+}
+
+// Make a cursor become ready, or return the error.
+// If ctx is done the computation is abandoned and the context error returned.
+func (c *Cursor) ComputeStateContext(ctx context.Context) (computeErr error) {
 	c.computeMutex.Lock()
-	defer c.computeMutex.Unlock()
+	defer c.unlockAndSend()
 	if c.ready {
 		return nil
 	}
@@ -652,10 +808,10 @@ func (c *Cursor) ComputeState() (computeErr error) {
 
 	// Fill the last snapshot if needed
 	if c.lastSnapshot == nil {
-		if err := c.fillLastSnapshot(); err != nil {
+		if err := c.fillLastSnapshot(ctx); err != nil {
 			return err
 		}
-		if err := c.fillNextSnapshot(); err != nil {
+		if err := c.fillNextSnapshot(ctx); err != nil {
 			return err
 		}
 	}
@@ -665,6 +821,9 @@ func (c *Cursor) ComputeState() (computeErr error) {
 	if c.timestamp.Equal(c.lastSnapshot.Timestamp) {
 		err = c.copySnapshotState()
 		c.nextSnapshot = nil
+		if err == nil {
+			err = c.queueReset()
+		}
 	} else if c.computedState != nil {
 		// If we have a computed state, we can move it to the target state
 		// This is enforced in SetTimestamp()
@@ -672,35 +831,41 @@ func (c *Cursor) ComputeState() (computeErr error) {
 		// We need to rewind the cursor
 		if c.computedTimestamp.After(c.timestamp) {
 			err = c.rewindState()
+			if err == nil {
+				err = c.queueReset()
+			}
 		} else {
 			// We need to fast-forward the cursor
 			// First fast forward the snapshot, IF we have no entry subscriptions.
 			if len(c.entrySubscriptions) == 0 && c.nextSnapshot != nil && c.nextSnapshot.Timestamp.Before(c.timestamp) {
 				c.lastSnapshot = c.nextSnapshot
 				c.nextSnapshot = nil
-				if err := c.fillNextSnapshot(); err != nil {
+				if err := c.fillNextSnapshot(ctx); err != nil {
 					return err
 				}
 				// If the next snapshot is STILL before the timestamp
-				if c.nextSnapshot.Timestamp.Before(c.timestamp) {
+				if c.nextSnapshot != nil && c.nextSnapshot.Timestamp.Before(c.timestamp) {
 					// Fast forward
 					c.lastSnapshot = nil
 					c.nextSnapshot = nil
-					if err := c.fillLastSnapshot(); err != nil {
+					if err := c.fillLastSnapshot(ctx); err != nil {
 						return err
 					}
-					if err := c.fillNextSnapshot(); err != nil {
+					if err := c.fillNextSnapshot(ctx); err != nil {
 						return err
 					}
 				}
 			}
-			err = c.fastForwardState()
+			err = c.fastForwardState(ctx)
 		}
 	} else {
 		c.computedTimestamp = c.lastSnapshot.Timestamp
 		err = c.copySnapshotState()
 		if err == nil {
-			err = c.fastForwardState()
+			err = c.queueReset()
+		}
+		if err == nil {
+			err = c.fastForwardState(ctx)
 		}
 	}
 
@@ -0,0 +1,135 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// A state to write at a timestamp.
+type StateWrite struct {
+	Timestamp time.Time
+	State     StateData
+}
+
+// Records the entries made by a write cursor, to store them as one batch.
+type batchRecorder struct {
+	entries []*StreamEntry
+}
+
+func (r *batchRecorder) GetSnapshotBeforeContext(ctx context.Context, timestamp time.Time) (*StreamEntry, error) {
+	return nil, errors.New("Cannot read from a write batch.")
+}
+
+func (r *batchRecorder) GetEntryAfterContext(ctx context.Context, timestamp time.Time, filterType StreamEntryType) (*StreamEntry, error) {
+	return nil, errors.New("Cannot read from a write batch.")
+}
+
+func (r *batchRecorder) SaveEntryContext(ctx context.Context, entry *StreamEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.entries = append(r.entries, entry)
+	return nil
+}
+
+// Replace the entry at oldTimestamp. Entries not in the batch are replaced
+// when the batch is stored.
+func (r *batchRecorder) AmendEntryContext(ctx context.Context, entry *StreamEntry, oldTimestamp time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for i, ent := range r.entries {
+		if ent.Timestamp.Equal(oldTimestamp) {
+			r.entries[i] = entry
+			return nil
+		}
+	}
+	r.entries = append(r.entries, entry)
+	return nil
+}
+
+// Writes states to the end of the stream as one unit. The storage must be a
+// BatchStorageBackend. Either every resulting entry is stored, or none are and
+// the cursor is left unchanged.
+func (c *Cursor) WriteBatch(states []*StateWrite, config *RateConfig) (writeError error) {
+	return c.WriteBatchContext(context.Background(), states, config)
+}
+
+// Writes states as one unit, with a context for the writes.
+func (c *Cursor) WriteBatchContext(ctx context.Context, states []*StateWrite, config *RateConfig) (writeError error) {
+	batch, ok := c.storage.(BatchStorageBackend)
+	if !ok {
+		return errors.New("Storage backend does not support batch writes.")
+	}
+
+	c.computeMutex.Lock()
+	subs := c.entrySubscribers()
+	var savedEntries []*StreamEntry
+	defer func() {
+		if writeError != nil {
+			return
+		}
+		for _, entry := range savedEntries {
+			sendEntry(subs, entry)
+		}
+	}()
+	defer c.computeMutex.Unlock()
+
+	restore, err := c.saveWriteState()
+	if err != nil {
+		return err
+	}
+	recorder := &batchRecorder{}
+	for _, write := range states {
+		savedEntry, err := c.writeState(ctx, recorder, write.Timestamp, write.State, config)
+		if err != nil {
+			restore()
+			return err
+		}
+		if savedEntry != nil {
+			savedEntries = append(savedEntries, savedEntry)
+		}
+	}
+	if len(recorder.entries) == 0 {
+		return nil
+	}
+	err = ctx.Err()
+	if err == nil {
+		err = batch.SaveEntries(recorder.entries)
+	}
+	if err != nil {
+		restore()
+		return err
+	}
+	return nil
+}
+
+// Copy the fields changed by writes, returning a func to restore them.
+// Note: Lock computeMutex before calling
+func (c *Cursor) saveWriteState() (func(), error) {
+	var computedState, lastState *StateDataPtr
+	var err error
+	if c.computedState != nil {
+		if computedState, err = c.computedState.Clone(); err != nil {
+			return nil, err
+		}
+	}
+	if c.lastState != nil {
+		if lastState, err = c.lastState.Clone(); err != nil {
+			return nil, err
+		}
+	}
+	ready := c.ready
+	lastSnapshot := c.lastSnapshot
+	lastMutation := c.lastMutation
+	computedTimestamp := c.computedTimestamp
+	return func() {
+		c.ready = ready
+		c.lastSnapshot = lastSnapshot
+		c.lastMutation = lastMutation
+		c.computedState = computedState
+		c.lastState = lastState
+		c.computedTimestamp = computedTimestamp
+	}, nil
+}
@@ -0,0 +1,248 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Size of the buffer for entry notifications from storage.
+const followEntryBufferSize = 100
+
+// A read-only cursor that stays at the head of a stream, like a write cursor.
+// New entries are applied as the storage reports them, and each updated
+// state is sent on the States channel.
+//
+// Notifications only wake the cursor up, entries are read back from storage,
+// so notifications dropped by the storage backend are not missed. With a
+// ChangeFeedStorageBackend, amended and removed entries are followed too.
+type FollowCursor struct {
+	cursor  *Cursor
+	storage StorageBackend
+
+	entries chan *StreamEntry
+	changes chan *StreamEntryChange
+	states  chan *TimestampedState
+	stop    chan struct{}
+
+	// Removes the entries or changes channel from the storage.
+	unsubscribe func()
+
+	// Error that stopped the cursor
+	err     error
+	errLock sync.Mutex
+
+	stopOnce sync.Once
+}
+
+// Start following the head of the stream. The storage backend must be a
+// ChangeFeedStorageBackend or a StreamingStorageBackend.
+func (s *Stream) Follow() (*FollowCursor, error) {
+	f := &FollowCursor{
+		storage: s.storage,
+		states:  make(chan *TimestampedState, 1),
+		stop:    make(chan struct{}),
+	}
+	// Subscribe first so no entries are missed while initializing.
+	if changeFeed, ok := s.storage.(ChangeFeedStorageBackend); ok {
+		f.changes = make(chan *StreamEntryChange, followEntryBufferSize)
+		changeFeed.EntryChanged(f.changes)
+		f.unsubscribe = func() { changeFeed.StopEntryChanged(f.changes) }
+	} else if streaming, ok := s.storage.(StreamingStorageBackend); ok {
+		f.entries = make(chan *StreamEntry, followEntryBufferSize)
+		streaming.EntryAdded(f.entries)
+		f.unsubscribe = func() { streaming.StopEntryAdded(f.entries) }
+	} else {
+		return nil, errors.New("Storage backend does not support streaming entries.")
+	}
+	cursor := newFollowCursor(s.storage)
+	if err := cursor.Init(endOfTime); err != nil && err != NoDataError {
+		f.unsubscribe()
+		return nil, err
+	}
+	if cursor.Ready() {
+		f.cursor = cursor
+	}
+	go f.run()
+	return f, nil
+}
+
+// Updated states, starting with the state when following started.
+// Closed when the cursor stops.
+func (f *FollowCursor) States() <-chan *TimestampedState {
+	return f.states
+}
+
+// Stop following and unsubscribe from the storage. The States channel is closed.
+func (f *FollowCursor) Stop() {
+	f.stopOnce.Do(func() {
+		f.unsubscribe()
+		close(f.stop)
+	})
+}
+
+// Get the error that stopped the cursor, if any.
+func (f *FollowCursor) Error() error {
+	f.errLock.Lock()
+	defer f.errLock.Unlock()
+	return f.err
+}
+
+func (f *FollowCursor) run() {
+	defer close(f.states)
+
+	if f.cursor != nil && !f.emit() {
+		return
+	}
+	for {
+		var updated bool
+		var err error
+		select {
+		case <-f.stop:
+			return
+		case entry := <-f.entries:
+			updated, err = f.handleEntry(entry)
+		case change := <-f.changes:
+			updated, err = f.handleChange(change)
+		}
+		if err != nil {
+			f.errLock.Lock()
+			f.err = err
+			f.errLock.Unlock()
+			return
+		}
+		if updated && !f.emit() {
+			return
+		}
+	}
+}
+
+// Bring the cursor up to date with an added entry.
+func (f *FollowCursor) handleEntry(entry *StreamEntry) (bool, error) {
+	var computed time.Time
+	if f.cursor == nil {
+		// No data when we started, begin at the first snapshot.
+		snap, err := f.storage.GetEntryAfter(time.Time{}, StreamEntrySnapshot)
+		if err != nil || snap == nil {
+			return false, err
+		}
+		cursor := newFollowCursor(f.storage)
+		if err := cursor.InitWithSnapshot(snap); err != nil {
+			return false, err
+		}
+		f.cursor = cursor
+		f.cursor.SetTimestamp(endOfTime)
+	} else {
+		computed = f.cursor.ComputedTimestamp()
+		if !entry.Timestamp.After(computed) {
+			// Already applied while catching up.
+			return false, nil
+		}
+		f.cursor.Invalidate()
+	}
+	if err := f.cursor.ComputeState(); err != nil {
+		return false, err
+	}
+	return f.cursor.ComputedTimestamp().After(computed), nil
+}
+
+// Bring the cursor up to date with a change to the stored entries.
+func (f *FollowCursor) handleChange(change *StreamEntryChange) (bool, error) {
+	if change.Type == StreamEntryAdded {
+		return f.handleEntry(change.Entry)
+	}
+	if f.cursor == nil {
+		return false, nil
+	}
+
+	changed := change.OldTimestamp
+	if change.Entry != nil && change.Entry.Timestamp.Before(changed) {
+		changed = change.Entry.Timestamp
+	}
+	if changed.After(f.cursor.ComputedTimestamp()) {
+		if change.Entry == nil {
+			return false, nil
+		}
+		return f.handleEntry(change.Entry)
+	}
+
+	// Write cursors amend the last entry on most writes, re-apply just that.
+	if change.Type == StreamEntryAmended {
+		if amended, err := f.cursor.amendLastEntry(change.Entry, change.OldTimestamp); amended || err != nil {
+			return amended, err
+		}
+	}
+
+	// An entry further back changed, rebuild the state from storage.
+	cursor := newFollowCursor(f.storage)
+	if err := cursor.Init(endOfTime); err != nil {
+		if err == NoDataError {
+			f.cursor = nil
+			return false, nil
+		}
+		return false, err
+	}
+	f.cursor = cursor
+	return true, nil
+}
+
+// Build a read-forward cursor able to re-apply an amended last entry.
+func newFollowCursor(storage StorageBackend) *Cursor {
+	cursor := newCursor(storage, ReadForwardCursor)
+	cursor.keepLastState = true
+	return cursor
+}
+
+// Replace the last applied entry, at oldTimestamp, with entry, starting from
+// the state before it. Returns false if the entry can't be replaced that way,
+// and the state must be rebuilt.
+func (c *Cursor) amendLastEntry(entry *StreamEntry, oldTimestamp time.Time) (bool, error) {
+	c.computeMutex.Lock()
+	defer c.computeMutex.Unlock()
+
+	if !c.ready || !c.computedTimestamp.Equal(oldTimestamp) ||
+		entry.Timestamp.Before(oldTimestamp) || entry.Timestamp.After(c.timestamp) {
+		return false, nil
+	}
+	if c.lastMutation != nil && c.lastMutation.Timestamp.Equal(oldTimestamp) {
+		// Rewind to the state before the last mutation.
+		c.computedState = c.lastState
+	} else if c.lastMutation != nil || c.lastSnapshot == nil ||
+		!c.lastSnapshot.Timestamp.Equal(oldTimestamp) || entry.Type != StreamEntrySnapshot {
+		// We only know the state before a mutation.
+		return false, nil
+	}
+
+	var err error
+	if entry.Type == StreamEntrySnapshot {
+		c.lastSnapshot = entry
+		c.nextSnapshot = nil
+		err = c.copySnapshotState()
+	} else {
+		err = c.applyMutation(entry)
+	}
+	if err != nil {
+		c.computedState = nil
+		c.ready = false
+		return false, err
+	}
+	return true, nil
+}
+
+// Send the current state, returning false if stopped.
+func (f *FollowCursor) emit() bool {
+	state, err := f.cursor.State()
+	if err != nil {
+		return true
+	}
+	update := &TimestampedState{
+		Timestamp: f.cursor.ComputedTimestamp(),
+		State:     CloneStateData(state).StateData,
+	}
+	select {
+	case f.states <- update:
+		return true
+	case <-f.stop:
+		return false
+	}
+}
@@ -0,0 +1,127 @@
+package stream
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Counts snapshot queries, each cursor rebuild makes one.
+type snapshotCountingBackend struct {
+	*MemoryBackend
+	snapshotCalls int32
+}
+
+func (sb *snapshotCountingBackend) GetSnapshotBefore(timestamp time.Time) (*StreamEntry, error) {
+	atomic.AddInt32(&sb.snapshotCalls, 1)
+	return sb.MemoryBackend.GetSnapshotBefore(timestamp)
+}
+
+func nextFollowState(t *testing.T, follow *FollowCursor) *TimestampedState {
+	select {
+	case state, ok := <-follow.States():
+		if !ok {
+			t.Fatalf("States closed: %v", follow.Error())
+		}
+		return state
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for a state.")
+	}
+	return nil
+}
+
+func TestFollowCursor(t *testing.T) {
+	stream, err := NewStream(&MemoryBackend{}, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	stream.DisableAmends()
+
+	follow, err := stream.Follow()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer follow.Stop()
+
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		timestamp := start.Add(time.Duration(i) * time.Second)
+		if err := stream.WriteState(timestamp, StateData{"test": i}); err != nil {
+			t.Fatalf(err.Error())
+		}
+		state := nextFollowState(t, follow)
+		if !state.Timestamp.Equal(timestamp) || state.State["test"] != float64(i) {
+			t.Fatalf("Expected state %d at %v, got %v at %v.", i, timestamp, state.State, state.Timestamp)
+		}
+	}
+
+	// A new follower starts with the current state.
+	follow2, err := stream.Follow()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if state := nextFollowState(t, follow2); state.State["test"] != float64(99) {
+		t.Fatalf("Unexpected initial state %v.", state.State)
+	}
+	follow2.Stop()
+	if _, ok := <-follow2.States(); ok {
+		t.Fatalf("Expected States to be closed after Stop.")
+	}
+	// Only the first follower is still subscribed.
+	storage := stream.storage.(*MemoryBackend)
+	storage.subscribersMtx.RLock()
+	subscribed := len(storage.changeSubscribers)
+	storage.subscribersMtx.RUnlock()
+	if subscribed != 1 {
+		t.Fatalf("Expected 1 change subscriber after Stop, got %d.", subscribed)
+	}
+
+	if _, err := (&Stream{storage: &MockStorageBackend{}}).Follow(); err == nil {
+		t.Fatalf("Expected an error for a backend without streaming.")
+	}
+}
+
+func TestFollowCursorAmends(t *testing.T) {
+	storage := &snapshotCountingBackend{MemoryBackend: &MemoryBackend{}}
+	stream, err := NewStream(storage, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	follow, err := stream.Follow()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer follow.Stop()
+
+	// Writes closer than the change frequency amend the last mutation.
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		timestamp := start.Add(time.Duration(i*100) * time.Millisecond)
+		if err := stream.WriteState(timestamp, StateData{"test": i}); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if state := nextFollowState(t, follow); state.State["test"] != float64(i) {
+			t.Fatalf("Expected state %d, got %v.", i, state.State)
+		}
+	}
+	// Only the initial cursors queried snapshots, amends did not rebuild.
+	if calls := atomic.LoadInt32(&storage.snapshotCalls); calls != 2 {
+		t.Fatalf("Expected 2 snapshot queries, got %d.", calls)
+	}
+
+	// Removing entries rebuilds the state.
+	if err := stream.DeleteBefore(start.Add(time.Hour)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	select {
+	case state := <-follow.States():
+		t.Fatalf("Expected no state after deleting every entry, got %v.", state)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := stream.WriteState(start.Add(time.Hour), StateData{"test": "new"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if state := nextFollowState(t, follow); state.State["test"] != "new" {
+		t.Fatalf("Unexpected state %v.", state.State)
+	}
+}
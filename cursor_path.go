@@ -0,0 +1,96 @@
+package stream
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/paralin/mutate"
+)
+
+// A change to the value at a path of the state.
+// Values are nil when the path is not set, and must not be modified.
+type PathChange struct {
+	Timestamp time.Time
+	Path      string
+	OldValue  interface{}
+	NewValue  interface{}
+}
+
+// Tracks the state and the value at a path as entries are applied.
+type pathWatcher struct {
+	path  string
+	keys  []string
+	state map[string]interface{}
+	value interface{}
+}
+
+func newPathWatcher(path string, keys []string) *pathWatcher {
+	return &pathWatcher{
+		path:  path,
+		keys:  keys,
+		state: make(map[string]interface{}),
+	}
+}
+
+// Apply an entry, returning the change or nil if the value is unchanged.
+func (w *pathWatcher) handleEntry(entry *StreamEntry) (interface{}, error) {
+	data := cloneValue(entry.Data).(map[string]interface{})
+	if entry.Type == StreamEntrySnapshot {
+		w.state = data
+	} else {
+		state, err := mutate.ApplyMutationObject(w.state, data)
+		if err != nil {
+			return nil, err
+		}
+		w.state = state
+	}
+
+	value := lookupPath(w.state, w.keys)
+	if reflect.DeepEqual(value, w.value) {
+		return nil, nil
+	}
+	change := &PathChange{
+		Timestamp: entry.Timestamp,
+		Path:      w.path,
+		OldValue:  w.value,
+		NewValue:  cloneValue(value),
+	}
+	w.value = change.NewValue
+	return change, nil
+}
+
+// Continue from a recomputed state, without reporting a change.
+func (w *pathWatcher) reset(state StateData) {
+	w.state = cloneValue(state).(map[string]interface{})
+	w.value = cloneValue(lookupPath(w.state, w.keys))
+}
+
+// Subscribe to changes of the value at a dotted path like "sensors.temp", as
+// the cursor applies or writes entries. Values below arrays are not supported.
+// When the cursor recomputes its state, from a snapshot or by rewinding, the
+// value is reset without reporting a change.
+func (c *Cursor) SubscribePath(path string, ch chan *PathChange, options *SubscriptionOptions) (CursorEntrySubscription, error) {
+	keys, err := splitPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if options == nil {
+		options = &SubscriptionOptions{}
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	watcher := newPathWatcher(path, keys)
+	c.computeMutex.Lock()
+	defer c.computeMutex.Unlock()
+	if c.ready && c.computedState != nil {
+		watcher.reset(c.computedState.StateData)
+	}
+	return c.addEntrySubscription(&cursorEntrySubscription{
+		ch:      reflect.ValueOf(ch),
+		options: *options,
+		filter:  watcher.handleEntry,
+		reset:   watcher.reset,
+	}), nil
+}
@@ -0,0 +1,117 @@
+package stream
+
+import (
+	"errors"
+	"time"
+)
+
+// Steps a read-forward cursor over stored entries, one entry at a time.
+type cursorReplay struct {
+	storage StorageBackend
+
+	// Nil until we reach data (a snapshot).
+	cursor *Cursor
+
+	// Timestamp of the last visited entry
+	timestamp time.Time
+}
+
+// Positions a replay at from. If there is no data at from, the cursor
+// is built when the first snapshot after from is reached.
+func newCursorReplay(storage StorageBackend, from time.Time) (*cursorReplay, error) {
+	cursor, err := initCursorAt(storage, ReadForwardCursor, from)
+	if err != nil {
+		return nil, err
+	}
+	return &cursorReplay{storage: storage, timestamp: from, cursor: cursor}, nil
+}
+
+// Builds a cursor initialized at timestamp, or nil if there is no data at timestamp.
+// Unlike Init, a first snapshot exactly at timestamp counts as data.
+func initCursorAt(storage StorageBackend, cursorType CursorType, timestamp time.Time) (*Cursor, error) {
+	cursor := newCursor(storage, cursorType)
+	if err := cursor.Init(timestamp); err != nil {
+		if err != NoDataError {
+			return nil, err
+		}
+		// GetSnapshotBefore excludes a snapshot exactly at timestamp.
+		snap, err := storage.GetEntryAfter(timestamp.Add(-time.Nanosecond), StreamEntrySnapshot)
+		if err != nil {
+			return nil, err
+		}
+		if snap == nil || !snap.Timestamp.Equal(timestamp) {
+			return nil, nil
+		}
+		cursor = newCursor(storage, cursorType)
+		if err := cursor.InitWithSnapshot(snap); err != nil {
+			return nil, err
+		}
+	}
+	return cursor, nil
+}
+
+// Get a copy of the state at the current position, or nil if there is no data yet.
+func (r *cursorReplay) State() (StateData, error) {
+	if r.cursor == nil {
+		return nil, nil
+	}
+	state, err := r.cursor.State()
+	if err != nil {
+		return nil, err
+	}
+	return CloneStateData(state).StateData, nil
+}
+
+// Get the last snapshot at or before the current position.
+func (r *cursorReplay) LastSnapshot() *StreamEntry {
+	if r.cursor == nil {
+		return nil
+	}
+	return r.cursor.lastSnapshot
+}
+
+// Get the timestamp of the last entry at or before the current position.
+func (r *cursorReplay) ComputedTimestamp() time.Time {
+	if r.cursor == nil {
+		return time.Time{}
+	}
+	return r.cursor.ComputedTimestamp()
+}
+
+// Steps to the next entry at or before to.
+// Returns the entry and a copy of the state after it, or a nil entry at the end.
+func (r *cursorReplay) Next(to time.Time) (*StreamEntry, StateData, error) {
+	entry, err := r.storage.GetEntryAfter(r.timestamp, StreamEntryAny)
+	if err != nil || entry == nil {
+		return nil, nil, err
+	}
+	if !entry.Timestamp.After(r.timestamp) {
+		return nil, nil, errors.New("Storage backend returned an entry before requested time.")
+	}
+	if entry.Timestamp.After(to) {
+		return nil, nil, nil
+	}
+	r.timestamp = entry.Timestamp
+
+	if r.cursor == nil {
+		if entry.Type != StreamEntrySnapshot {
+			return nil, nil, errors.New("Stream has a mutation before the first snapshot.")
+		}
+		cursor := newCursor(r.storage, ReadForwardCursor)
+		if err := cursor.InitWithSnapshot(entry); err != nil {
+			return nil, nil, err
+		}
+		r.cursor = cursor
+	} else {
+		r.cursor.SetTimestamp(entry.Timestamp)
+		if err := r.cursor.ComputeState(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	state, err := r.State()
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry, state, nil
+}
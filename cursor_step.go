@@ -0,0 +1,127 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var NoMoreEntriesError error = errors.New("No more entries in that direction.")
+
+// Move the cursor to the first stored entry after its timestamp.
+// Returns the timestamp of the entry and the state after it.
+func (c *Cursor) Next() (time.Time, StateData, error) {
+	if c.cursorType == WriteCursor {
+		return time.Time{}, nil, errors.New("Cannot step a write cursor.")
+	}
+	entry, err := c.storage.GetEntryAfter(c.timestamp, StreamEntryAny)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	if entry == nil {
+		return time.Time{}, nil, NoMoreEntriesError
+	}
+	if err := c.stepForward(entry); err != nil {
+		return time.Time{}, nil, err
+	}
+	state, err := c.State()
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	return entry.Timestamp, state, nil
+}
+
+// Move the cursor to entry, the first entry after its timestamp.
+func (c *Cursor) stepForward(entry *StreamEntry) (err error) {
+	c.computeMutex.Lock()
+	if c.ready && !c.computedTimestamp.After(c.timestamp) {
+		// The state is at the entry before, apply just this one.
+		defer c.unlockAndSend()
+		c.timestamp = entry.Timestamp
+		if err := c.fastForwardEntry(context.Background(), entry); err != nil {
+			c.computedState = nil
+			c.ready = false
+			return err
+		}
+		return nil
+	}
+	c.computeMutex.Unlock()
+
+	c.SetTimestamp(entry.Timestamp)
+	err = c.ComputeState()
+	if err == NoDataError && entry.Type == StreamEntrySnapshot {
+		// GetSnapshotBefore excludes the first snapshot of the stream.
+		return c.InitWithSnapshot(entry)
+	}
+	return err
+}
+
+// Move the cursor to the last stored entry before its timestamp.
+// Returns the timestamp of the entry and the state after it.
+// Only bidirectional cursors can step backwards. Steps within a keyframe
+// period use the rewind stack, stepping past a snapshot replays the period
+// before it.
+func (c *Cursor) Prev() (time.Time, StateData, error) {
+	if c.cursorType != ReadBidirectionalCursor {
+		return time.Time{}, nil, errors.New("Only bidirectional cursors can step backwards.")
+	}
+
+	c.computeMutex.Lock()
+	if !c.ready {
+		c.computeMutex.Unlock()
+		return time.Time{}, nil, errors.New("Computation is not ready.")
+	}
+	target, found := c.prevEntryTimestamp()
+	lastSnapshot := c.lastSnapshot
+	c.computeMutex.Unlock()
+
+	if found {
+		c.SetTimestamp(target)
+		if err := c.ComputeState(); err != nil {
+			return time.Time{}, nil, err
+		}
+	} else {
+		prevSnapshot, err := c.storage.GetSnapshotBefore(lastSnapshot.Timestamp)
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		if prevSnapshot == nil {
+			return time.Time{}, nil, NoMoreEntriesError
+		}
+		// Compute the state just before the snapshot, then move onto the
+		// entry it was computed at.
+		c.SetTimestamp(lastSnapshot.Timestamp.Add(-time.Nanosecond))
+		if err := c.ComputeState(); err != nil {
+			return time.Time{}, nil, err
+		}
+		c.computeMutex.Lock()
+		c.timestamp = c.computedTimestamp
+		target = c.timestamp
+		c.computeMutex.Unlock()
+	}
+
+	state, err := c.State()
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	return target, state, nil
+}
+
+// Find the last entry before the cursor timestamp from the rewind stack.
+// Returns false if it is before the last snapshot.
+// Note: Lock computeMutex before calling
+func (c *Cursor) prevEntryTimestamp() (time.Time, bool) {
+	// The state is at an entry before the timestamp.
+	if c.computedTimestamp.Before(c.timestamp) {
+		return c.computedTimestamp, true
+	}
+	for i := len(c.lastMutations) - 1; i >= 0; i-- {
+		if ts := c.lastMutations[i].Timestamp; ts.Before(c.computedTimestamp) {
+			return ts, true
+		}
+	}
+	if c.lastSnapshot.Timestamp.Before(c.computedTimestamp) {
+		return c.lastSnapshot.Timestamp, true
+	}
+	return time.Time{}, false
+}
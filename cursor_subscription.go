@@ -1,13 +1,220 @@
 package stream
 
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What to do with an entry when a subscriber's channel is full.
+type SubscriptionOverflowPolicy int
+
+const (
+	// Wait until the subscriber receives the entry. The call that applied the
+	// entry waits, other cursor calls do not. This is the behavior of SubscribeEntries.
+	OverflowBlock SubscriptionOverflowPolicy = iota
+	// Wait up to the subscription timeout, then drop the entry.
+	OverflowBlockTimeout
+	// Drop the oldest buffered entry to make room for the new one.
+	OverflowDropOldest
+	// Drop the new entry.
+	OverflowDropNewest
+	// Stop the subscription with SubscriberOverflowError. The channel is left open.
+	OverflowDisconnect
+)
+
+var SubscriberOverflowError error = errors.New("Subscriber channel is full, disconnected.")
+
+// Options for a cursor entry subscription.
+type SubscriptionOptions struct {
+	Policy SubscriptionOverflowPolicy
+	// How long to wait with OverflowBlockTimeout.
+	Timeout time.Duration
+}
+
+func (o *SubscriptionOptions) Validate() error {
+	switch o.Policy {
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowDisconnect:
+	case OverflowBlockTimeout:
+		if o.Timeout <= 0 {
+			return errors.New("Timeout must be > 0.")
+		}
+	default:
+		return errors.New("Unknown overflow policy.")
+	}
+	return nil
+}
+
 type CursorEntrySubscription interface {
 	Unsubscribe()
+	// Number of entries dropped because the channel was full.
+	Dropped() uint64
+	// Error the subscription was stopped with, if any.
+	Err() error
+	// Closed when the subscription stops, after Unsubscribe or an error.
+	// The subscriber's channel is never closed.
+	Done() <-chan struct{}
 }
 
 type cursorEntrySubscription struct {
+	// First, so it is 64-bit aligned for atomic access
+	dropped uint64
+
+	// The subscriber's channel, *StreamEntry or *PathChange
+	ch      reflect.Value
+	options SubscriptionOptions
+	// Converts an entry to the value to send, nil to skip the entry
+	filter func(entry *StreamEntry) (interface{}, error)
+	// For a filter tracking the state, called when the cursor recomputes it
+	reset func(state StateData)
+
+	// Set once unsubscribed or disconnected
+	stopped int32
+
+	// Serializes sends and resets
+	sendMtx sync.Mutex
+	err     error
+
 	unsubFunc func()
+	done      chan struct{}
+	doneOnce  sync.Once
 }
 
 func (s *cursorEntrySubscription) Unsubscribe() {
+	atomic.StoreInt32(&s.stopped, 1)
+	s.doneOnce.Do(func() { close(s.done) })
 	s.unsubFunc()
 }
+
+func (s *cursorEntrySubscription) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *cursorEntrySubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *cursorEntrySubscription) Err() error {
+	s.sendMtx.Lock()
+	defer s.sendMtx.Unlock()
+	return s.err
+}
+
+// Send an entry following the overflow policy.
+func (s *cursorEntrySubscription) send(entry *StreamEntry) {
+	if atomic.LoadInt32(&s.stopped) != 0 {
+		return
+	}
+
+	s.sendMtx.Lock()
+	stopped := s.sendLocked(entry)
+	s.sendMtx.Unlock()
+	// Remove the subscription from the cursor.
+	if stopped {
+		s.unsubFunc()
+	}
+}
+
+// Send an entry, returning true if the subscription was stopped with an error.
+// Note: Lock sendMtx before calling
+func (s *cursorEntrySubscription) sendLocked(entry *StreamEntry) bool {
+	if s.err != nil {
+		return false
+	}
+
+	var val reflect.Value
+	if s.filter == nil {
+		val = reflect.ValueOf(entry)
+	} else {
+		res, err := s.filter(entry)
+		if err != nil {
+			s.stop(err)
+			return true
+		}
+		if res == nil {
+			return false
+		}
+		val = reflect.ValueOf(res)
+	}
+
+	if s.options.Policy == OverflowBlock {
+		s.ch.Send(val)
+		return false
+	}
+	if s.ch.TrySend(val) {
+		return false
+	}
+
+	switch s.options.Policy {
+	case OverflowBlockTimeout:
+		timer := time.NewTimer(s.options.Timeout)
+		defer timer.Stop()
+		chosen, _, _ := reflect.Select([]reflect.SelectCase{
+			{Dir: reflect.SelectSend, Chan: s.ch, Send: val},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)},
+		})
+		if chosen == 0 {
+			return false
+		}
+	case OverflowDropOldest:
+		// The subscriber may drain the channel concurrently, so only count
+		// the entries we actually remove.
+		canRecv := s.ch.Type().ChanDir()&reflect.RecvDir != 0
+		for {
+			if canRecv {
+				if _, ok := s.ch.TryRecv(); ok {
+					atomic.AddUint64(&s.dropped, 1)
+				}
+			}
+			if s.ch.TrySend(val) {
+				return false
+			}
+			if !canRecv || s.ch.Cap() == 0 {
+				break
+			}
+		}
+	case OverflowDisconnect:
+		s.stop(SubscriberOverflowError)
+		atomic.AddUint64(&s.dropped, 1)
+		return true
+	}
+	atomic.AddUint64(&s.dropped, 1)
+	return false
+}
+
+// Reset a subscription tracking the state to a recomputed state.
+func (s *cursorEntrySubscription) resetState(state StateData) {
+	if s.reset == nil || atomic.LoadInt32(&s.stopped) != 0 {
+		return
+	}
+
+	s.sendMtx.Lock()
+	defer s.sendMtx.Unlock()
+	if s.err == nil {
+		s.reset(state)
+	}
+}
+
+// Stop the subscription with an error, closing done. The channel belongs to
+// the subscriber and is left open.
+// Note: Lock sendMtx before calling
+func (s *cursorEntrySubscription) stop(err error) {
+	s.err = err
+	atomic.StoreInt32(&s.stopped, 1)
+	s.doneOnce.Do(func() { close(s.done) })
+}
+
+// Send an entry to each subscription.
+func sendEntry(subs []*cursorEntrySubscription, entry *StreamEntry) {
+	for _, sub := range subs {
+		sub.send(entry)
+	}
+}
+
+// An entry applied by the cursor, or a state it recomputed, to send after unlocking.
+type pendingSend struct {
+	entry *StreamEntry
+	state StateData
+}
@@ -1,8 +1,11 @@
 package stream
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -15,15 +18,16 @@ type MockStorageBackend struct {
 }
 
 func (sb *MockStorageBackend) GetSnapshotBefore(timestamp time.Time) (*StreamEntry, error) {
+	var snap *StreamEntry
 	for _, entry := range sb.Entries {
-		if entry.Timestamp.After(timestamp) {
+		if !entry.Timestamp.Before(timestamp) {
 			break
 		}
 		if entry.Type == StreamEntrySnapshot {
-			return entry, nil
+			snap = entry
 		}
 	}
-	return nil, nil
+	return snap, nil
 }
 
 func (sb *MockStorageBackend) GetEntryAfter(timestamp time.Time, filterType StreamEntryType) (*StreamEntry, error) {
@@ -39,7 +43,11 @@ func (sb *MockStorageBackend) GetEntryAfter(timestamp time.Time, filterType Stre
 }
 
 func (sb *MockStorageBackend) SaveEntry(entry *StreamEntry) error {
-	sb.Entries = append(sb.Entries, entry)
+	idx := len(sb.Entries)
+	for idx > 0 && sb.Entries[idx-1].Timestamp.After(entry.Timestamp) {
+		idx--
+	}
+	sb.Entries = append(sb.Entries[:idx], append([]*StreamEntry{entry}, sb.Entries[idx:]...)...)
 	return nil
 }
 
@@ -53,6 +61,15 @@ func (sb *MockStorageBackend) AmendEntry(entry *StreamEntry, timestamp time.Time
 	return errors.New("Entry not found.")
 }
 
+func (sb *MockStorageBackend) ForEachEntry(cb func(entry *StreamEntry) error) error {
+	for _, entry := range sb.Entries {
+		if err := cb(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func TestSetTimestampBeforeSnapshot(t *testing.T) {
 	// snapshot is at now
 	// target timestamp is at snapshot - 1 second
@@ -348,6 +365,43 @@ func TestRewindStateSimple(t *testing.T) {
 	}
 }
 
+// Rewinding to the exact timestamp of a mutation keeps that mutation applied,
+// the same as computing the state forward to it.
+func TestRewindStateExactTimestamp(t *testing.T) {
+	snapshotTime := time.Now().Add(-time.Hour)
+	storage := &MemoryBackend{}
+	storage.SaveEntry(&StreamEntry{
+		Type:      StreamEntrySnapshot,
+		Timestamp: snapshotTime,
+		Data:      StateData{"test": 0},
+	})
+	for i := 1; i <= 3; i++ {
+		storage.SaveEntry(&StreamEntry{
+			Type:      StreamEntryMutation,
+			Timestamp: snapshotTime.Add(time.Duration(i) * time.Second),
+			Data:      StateData{"test": i},
+		})
+	}
+
+	cursor := newCursor(storage, ReadBidirectionalCursor)
+	if err := cursor.Init(snapshotTime.Add(5 * time.Second)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 2; i >= 0; i-- {
+		timestamp := snapshotTime.Add(time.Duration(i) * time.Second)
+		cursor.SetTimestamp(timestamp)
+		if err := cursor.ComputeState(); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if data, _ := cursor.State(); data["test"] != float64(i) {
+			t.Fatalf("Rewound to entry %d, got state %v.", i, data)
+		}
+		if computed := cursor.ComputedTimestamp(); !computed.Equal(timestamp) {
+			t.Fatalf("Rewound to entry %d, computed timestamp is %v.", i, computed)
+		}
+	}
+}
+
 func TestFastForwardStateSimple(t *testing.T) {
 	// snapshot is at now - 10 seconds
 	// mutations at now - 10 sec, now - 9 sec, etc.
@@ -369,7 +423,7 @@ func TestFastForwardStateSimple(t *testing.T) {
 			Data:      NewStateData().StateData,
 		},
 	}
-	cursor.entrySubscriptions = make(map[int]chan<- *StreamEntry)
+	cursor.entrySubscriptions = make(map[int]*cursorEntrySubscription)
 	cursor.computedState.StateData["test"] = "veryold"
 	cursor.lastSnapshot.Data["test"] = "veryold"
 
@@ -522,3 +576,395 @@ func CheckValidComputation(cursor *Cursor) error {
 	}
 	return nil
 }
+
+// Counts single-entry queries against a backend
+type countingStorageBackend struct {
+	*MemoryBackend
+	entryAfterCalls int
+}
+
+func (sb *countingStorageBackend) GetEntryAfter(timestamp time.Time, filterType StreamEntryType) (*StreamEntry, error) {
+	sb.entryAfterCalls++
+	return sb.MemoryBackend.GetEntryAfter(timestamp, filterType)
+}
+
+func TestFastForwardRange(t *testing.T) {
+	snapshotTime := time.Now().Add(-time.Hour)
+	storage := &countingStorageBackend{MemoryBackend: &MemoryBackend{}}
+	storage.SaveEntry(&StreamEntry{
+		Type:      StreamEntrySnapshot,
+		Timestamp: snapshotTime,
+		Data:      StateData{"test": 0},
+	})
+	for i := 1; i < 250; i++ {
+		storage.SaveEntry(&StreamEntry{
+			Type:      StreamEntryMutation,
+			Timestamp: snapshotTime.Add(time.Duration(i) * time.Second),
+			Data:      StateData{"test": i},
+		})
+	}
+
+	cursor := newCursor(storage, ReadForwardCursor)
+	if err := cursor.Init(snapshotTime.Add(time.Duration(200) * time.Second)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if data, _ := cursor.State(); data["test"] != 200 {
+		t.Fatalf("Unexpected state %v.", data)
+	}
+	// Only the next snapshot lookup should use GetEntryAfter.
+	if storage.entryAfterCalls > 1 {
+		t.Fatalf("Fast-forward made %d GetEntryAfter calls.", storage.entryAfterCalls)
+	}
+}
+
+func TestComputeStateContextCanceled(t *testing.T) {
+	snapshotTime := time.Now().Add(-time.Hour)
+	storage := &MemoryBackend{}
+	storage.SaveEntry(&StreamEntry{
+		Type:      StreamEntrySnapshot,
+		Timestamp: snapshotTime,
+		Data:      StateData{"test": 0},
+	})
+	storage.SaveEntry(&StreamEntry{
+		Type:      StreamEntryMutation,
+		Timestamp: snapshotTime.Add(time.Second),
+		Data:      StateData{"test": 1},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cursor := newCursor(storage, ReadForwardCursor)
+	if err := cursor.InitContext(ctx, snapshotTime.Add(2*time.Second)); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v.", err)
+	}
+	if cursor.Ready() {
+		t.Fatalf("Cursor should not be ready after a canceled computation.")
+	}
+	if err := cursor.ComputeState(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if data, _ := cursor.State(); data["test"] != 1 {
+		t.Fatalf("Unexpected state %v.", data)
+	}
+}
+
+func TestSubscriptionOverflow(t *testing.T) {
+	writeStates := func(sub func(cursor *Cursor)) {
+		stream, err := NewStream(&MockStorageBackend{Entries: []*StreamEntry{}}, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		cursor, err := stream.WriteCursor()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		sub(cursor)
+		now := time.Now()
+		for i := 0; i < 3; i++ {
+			now = now.Add(2 * time.Second)
+			if err := CheckWriteState(stream, fmt.Sprintf(`{"test":%d}`, i), now); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+	subscribe := func(cursor *Cursor, ch chan *StreamEntry, options *SubscriptionOptions) CursorEntrySubscription {
+		sub, err := cursor.SubscribeEntriesWithOptions(ch, options)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return sub
+	}
+
+	var sub CursorEntrySubscription
+	ch := make(chan *StreamEntry, 1)
+	writeStates(func(cursor *Cursor) {
+		sub = subscribe(cursor, ch, &SubscriptionOptions{Policy: OverflowDropNewest})
+	})
+	if sub.Dropped() != 2 || (<-ch).Data["test"] != float64(0) {
+		t.Fatalf("Drop newest kept the wrong entries, dropped %d.", sub.Dropped())
+	}
+
+	ch = make(chan *StreamEntry, 1)
+	writeStates(func(cursor *Cursor) {
+		sub = subscribe(cursor, ch, &SubscriptionOptions{Policy: OverflowDropOldest})
+	})
+	if sub.Dropped() != 2 || (<-ch).Data["test"] != float64(2) {
+		t.Fatalf("Drop oldest kept the wrong entries, dropped %d.", sub.Dropped())
+	}
+
+	ch = make(chan *StreamEntry, 1)
+	writeStates(func(cursor *Cursor) {
+		sub = subscribe(cursor, ch, &SubscriptionOptions{Policy: OverflowBlockTimeout, Timeout: time.Millisecond})
+	})
+	if sub.Dropped() != 2 || len(ch) != 1 {
+		t.Fatalf("Block with timeout dropped %d entries.", sub.Dropped())
+	}
+
+	ch = make(chan *StreamEntry, 1)
+	var subCursor *Cursor
+	writeStates(func(cursor *Cursor) {
+		subCursor = cursor
+		sub = subscribe(cursor, ch, &SubscriptionOptions{Policy: OverflowDisconnect})
+	})
+	if sub.Err() != SubscriberOverflowError || sub.Dropped() != 1 {
+		t.Fatalf("Subscription was not disconnected: %v", sub.Err())
+	}
+	select {
+	case <-sub.Done():
+	default:
+		t.Fatalf("Done was not closed on disconnect.")
+	}
+	var subCount int
+	subCursor.WriteGuard(func() error {
+		subCount = len(subCursor.entrySubscriptions)
+		return nil
+	})
+	if subCount != 0 {
+		t.Fatalf("Disconnected subscription was not removed from the cursor.")
+	}
+	if _, ok := <-ch; !ok {
+		t.Fatalf("Buffered entry was lost on disconnect.")
+	}
+	// The channel belongs to the subscriber and stays open.
+	select {
+	case entry, ok := <-ch:
+		t.Fatalf("Unexpected receive after disconnect: %v, open %v.", entry, ok)
+	default:
+	}
+	close(ch)
+}
+
+func TestSubscribePath(t *testing.T) {
+	stream, err := NewStream(&MockStorageBackend{Entries: []*StreamEntry{}}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cursor, err := stream.WriteCursor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ch := make(chan *PathChange, 10)
+	sub, err := cursor.SubscribePath("sensors.temp", ch, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	now := time.Now()
+	states := []struct {
+		state   string
+		advance time.Duration
+	}{
+		{`{"sensors":{"temp":1,"hum":5}}`, 0},
+		{`{"sensors":{"temp":1,"hum":6}}`, 2 * time.Second},
+		{`{"sensors":{"temp":2,"hum":6}}`, 2 * time.Second},
+		// Amends the last mutation
+		{`{"sensors":{"temp":{"c":3}},"other":true}`, 10 * time.Millisecond},
+		{`{"sensors":{"temp":{"c":4}}}`, 2 * time.Second},
+		{`{"sensors":"off"}`, 2 * time.Second},
+	}
+	for _, s := range states {
+		now = now.Add(s.advance)
+		if err := CheckWriteState(stream, s.state, now); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	sub.Unsubscribe()
+
+	expected := [][2]string{
+		{`null`, `1`},
+		{`1`, `2`},
+		{`2`, `{"c":3}`},
+		{`{"c":3}`, `{"c":4}`},
+		{`{"c":4}`, `null`},
+	}
+	if len(ch) != len(expected) {
+		t.Fatalf("Expected %d path changes, got %d.", len(expected), len(ch))
+	}
+	for _, exp := range expected {
+		change := <-ch
+		oldVal, _ := json.Marshal(change.OldValue)
+		newVal, _ := json.Marshal(change.NewValue)
+		if change.Path != "sensors.temp" || string(oldVal) != exp[0] || string(newVal) != exp[1] {
+			t.Fatalf("Unexpected change %s -> %s, expected %s -> %s.", oldVal, newVal, exp[0], exp[1])
+		}
+	}
+}
+
+func TestSubscribePathRecompute(t *testing.T) {
+	snapshotTime := time.Now().Add(-time.Hour)
+	storage := &MemoryBackend{}
+	storage.SaveEntry(&StreamEntry{
+		Type:      StreamEntrySnapshot,
+		Timestamp: snapshotTime,
+		Data:      StateData{"sensors": map[string]interface{}{"temp": 0}},
+	})
+	for i := 1; i < 4; i++ {
+		storage.SaveEntry(&StreamEntry{
+			Type:      StreamEntryMutation,
+			Timestamp: snapshotTime.Add(time.Duration(i) * time.Second),
+			Data:      StateData{"sensors": map[string]interface{}{"temp": i}},
+		})
+	}
+
+	cursor := newCursor(storage, ReadForwardCursor)
+	if err := cursor.Init(snapshotTime.Add(3 * time.Second)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	ch := make(chan *PathChange, 10)
+	sub, err := cursor.SubscribePath("sensors.temp", ch, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer sub.Unsubscribe()
+
+	// Moving back recomputes from the snapshot, resetting the value to 0
+	// silently, then applies the mutation at 1.
+	cursor.SetTimestamp(snapshotTime.Add(time.Second))
+	if err := cursor.ComputeState(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	cursor.SetTimestamp(snapshotTime.Add(3 * time.Second))
+	if err := cursor.ComputeState(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for _, exp := range [][2]string{{"0", "1"}, {"1", "2"}, {"2", "3"}} {
+		select {
+		case change := <-ch:
+			oldVal, _ := json.Marshal(change.OldValue)
+			newVal, _ := json.Marshal(change.NewValue)
+			if string(oldVal) != exp[0] || string(newVal) != exp[1] {
+				t.Fatalf("Unexpected change %s -> %s, expected %s -> %s.", oldVal, newVal, exp[0], exp[1])
+			}
+		default:
+			t.Fatalf("Expected a change %s -> %s.", exp[0], exp[1])
+		}
+	}
+	if len(ch) != 0 {
+		t.Fatalf("Unexpected extra changes.")
+	}
+}
+
+func TestCursorStep(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	stream, storage := buildTestStream(t, start)
+	states := replayAllStates(t, storage, start.Add(-time.Second))
+
+	checkStep := func(timestamp time.Time, state StateData, err error, i int) {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		expectedTime := start.Add(time.Duration(i*2) * time.Second)
+		if !timestamp.Equal(expectedTime) || !reflect.DeepEqual(state, states[expectedTime.UnixNano()]) {
+			t.Fatalf("Step %d: unexpected state %v at %v.", i, state, timestamp)
+		}
+	}
+
+	// Step from before the stream starts, across two snapshots.
+	cursor := stream.BuildCursor(ReadBidirectionalCursor)
+	if err := cursor.Init(start.Add(-time.Second)); err != NoDataError {
+		t.Fatalf("Expected no data before the stream starts, got %v.", err)
+	}
+	for i := 0; i < 70; i++ {
+		timestamp, state, err := cursor.Next()
+		checkStep(timestamp, state, err, i)
+	}
+	for i := 68; i >= 0; i-- {
+		timestamp, state, err := cursor.Prev()
+		checkStep(timestamp, state, err, i)
+	}
+	if _, _, err := cursor.Prev(); err != NoMoreEntriesError {
+		t.Fatalf("Expected no more entries before the stream starts, got %v.", err)
+	}
+
+	// Stepping back from between entries lands on the entry before.
+	cursor = stream.BuildCursor(ReadBidirectionalCursor)
+	if err := cursor.Init(start.Add(121 * time.Second)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	timestamp, state, err := cursor.Prev()
+	checkStep(timestamp, state, err, 60)
+	timestamp, state, err = cursor.Prev()
+	checkStep(timestamp, state, err, 59)
+	timestamp, state, err = cursor.Next()
+	checkStep(timestamp, state, err, 60)
+
+	// Forward cursors only step forward.
+	cursor = stream.BuildCursor(ReadForwardCursor)
+	if err := cursor.Init(start.Add(297 * time.Second)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	timestamp, state, err = cursor.Next()
+	checkStep(timestamp, state, err, 149)
+	if _, _, err := cursor.Next(); err != NoMoreEntriesError {
+		t.Fatalf("Expected no more entries at the end of the stream, got %v.", err)
+	}
+	if _, _, err := cursor.Prev(); err == nil {
+		t.Fatalf("Expected an error stepping a forward cursor backwards.")
+	}
+}
+
+func TestSubscriptionBlockedSubscriber(t *testing.T) {
+	snapshotTime := time.Now().Add(-time.Hour)
+	storage := &MemoryBackend{}
+	storage.SaveEntry(&StreamEntry{
+		Type:      StreamEntrySnapshot,
+		Timestamp: snapshotTime,
+		Data:      StateData{"test": 0},
+	})
+	for i := 1; i < 4; i++ {
+		storage.SaveEntry(&StreamEntry{
+			Type:      StreamEntryMutation,
+			Timestamp: snapshotTime.Add(time.Duration(i) * time.Second),
+			Data:      StateData{"test": i},
+		})
+	}
+
+	cursor := newCursor(storage, ReadForwardCursor)
+	if err := cursor.Init(snapshotTime.Add(time.Millisecond)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// Never read until the end, the sends block.
+	ch := make(chan *StreamEntry)
+	sub := cursor.SubscribeEntries(ch)
+
+	cursor.SetTimestamp(snapshotTime.Add(3 * time.Second))
+	computed := make(chan error, 1)
+	go func() {
+		computed <- cursor.ComputeState()
+	}()
+
+	// The blocked subscriber must not stall other cursor calls.
+	done := make(chan error, 1)
+	go func() {
+		for !cursor.Ready() {
+			time.Sleep(time.Millisecond)
+		}
+		if err := cursor.ComputeState(); err != nil {
+			done <- err
+			return
+		}
+		sub.Unsubscribe()
+		_, err := cursor.State()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Cursor calls stalled on a blocked subscriber.")
+	}
+
+	// Receive the entry being sent, the rest are skipped after Unsubscribe.
+	if entry := <-ch; !entry.Timestamp.Equal(snapshotTime.Add(time.Second)) {
+		t.Fatalf("Unexpected entry at %v.", entry.Timestamp)
+	}
+	if err := <-computed; err != nil {
+		t.Fatalf(err.Error())
+	}
+	if data, _ := cursor.State(); data["test"] != 3 {
+		t.Fatalf("Unexpected state %v.", data)
+	}
+}
@@ -0,0 +1,115 @@
+package stream
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/paralin/mutate"
+)
+
+// Lays out a sequence of states as snapshots and mutations following a rate
+// config, the same way the write cursor does.
+type entryBuilder struct {
+	keyframeFrequency time.Duration
+	changeFrequency   time.Duration
+
+	// Keep one snapshot per keyframe period instead of mutations.
+	snapshotsOnly bool
+
+	// Built entries not yet taken
+	entries []*StreamEntry
+
+	// State after the last pushed state, nil if there is no data.
+	lastState StateData
+	// Timestamp of the last snapshot
+	lastSnapshot time.Time
+
+	// Last mutation we made, and the state before it, for amends.
+	lastMutation     *StreamEntry
+	lastMutationBase StateData
+
+	// Pending snapshot and the start of its period, in snapshotsOnly mode.
+	// Periods are aligned to multiples of the keyframe frequency, so building
+	// adjacent ranges separately gives the same snapshots as one range.
+	pendingSnapshot *StreamEntry
+	pendingStart    time.Time
+}
+
+// Build a builder continuing from lastState, with the last snapshot at lastSnapshot.
+func newEntryBuilder(rate *RateConfig, lastState StateData, lastSnapshot time.Time) *entryBuilder {
+	return &entryBuilder{
+		keyframeFrequency: time.Duration(rate.KeyframeFrequency) * time.Millisecond,
+		changeFrequency:   time.Duration(rate.ChangeFrequency) * time.Millisecond,
+		lastState:         lastState,
+		lastSnapshot:      lastSnapshot,
+	}
+}
+
+// Add the state at timestamp. The builder keeps state, do not modify it after.
+func (b *entryBuilder) push(timestamp time.Time, state StateData) {
+	if b.snapshotsOnly {
+		start := timestamp.Truncate(b.keyframeFrequency)
+		if b.pendingSnapshot != nil && !start.Equal(b.pendingStart) {
+			b.entries = append(b.entries, b.pendingSnapshot)
+		}
+		b.pendingStart = start
+		b.pendingSnapshot = &StreamEntry{
+			Type:      StreamEntrySnapshot,
+			Timestamp: timestamp,
+			Data:      state,
+		}
+		return
+	}
+
+	if b.lastMutation != nil && timestamp.Sub(b.lastMutation.Timestamp) < b.changeFrequency {
+		// Amend the last mutation, same as the write cursor.
+		b.lastMutation.Data = mutate.BuildMutation(CloneStateData(b.lastMutationBase).StateData, state)
+	} else if b.lastState == nil || timestamp.Sub(b.lastSnapshot) >= b.keyframeFrequency {
+		b.entries = append(b.entries, &StreamEntry{
+			Type:      StreamEntrySnapshot,
+			Timestamp: timestamp,
+			Data:      state,
+		})
+		b.lastSnapshot = timestamp
+		b.lastMutation = nil
+	} else if !reflect.DeepEqual(b.lastState, state) {
+		b.lastMutation = &StreamEntry{
+			Type:      StreamEntryMutation,
+			Timestamp: timestamp,
+			Data:      mutate.BuildMutation(CloneStateData(b.lastState).StateData, state),
+		}
+		b.lastMutationBase = b.lastState
+		b.entries = append(b.entries, b.lastMutation)
+	}
+	b.lastState = state
+}
+
+// Continue the period of a snapshot kept by an earlier snapshotsOnly build.
+// States pushed in the same period replace it.
+func (b *entryBuilder) continueSnapshot(snap *StreamEntry) {
+	b.pendingStart = snap.Timestamp.Truncate(b.keyframeFrequency)
+	b.pendingSnapshot = snap
+}
+
+// Take the built entries that later states can no longer amend.
+func (b *entryBuilder) takeFinal() []*StreamEntry {
+	n := len(b.entries)
+	if n > 0 && b.entries[n-1] == b.lastMutation {
+		n--
+	}
+	res := b.entries[:n]
+	b.entries = append([]*StreamEntry(nil), b.entries[n:]...)
+	return res
+}
+
+// Take every remaining entry, after the last state was pushed.
+func (b *entryBuilder) finish() []*StreamEntry {
+	if b.pendingSnapshot != nil {
+		b.entries = append(b.entries, b.pendingSnapshot)
+		b.pendingSnapshot = nil
+	}
+	res := b.entries
+	b.entries = nil
+	b.lastMutation = nil
+	return res
+}
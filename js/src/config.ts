@@ -1,5 +1,5 @@
 import { PROTO_DEFINITIONS } from './proto/definitions';
-export { IConfig, IRateConfig } from './proto/interfaces';
+export { IConfig, IRateConfig, IRetentionConfig, IRetentionTier } from './proto/interfaces';
 import { IConfig, IRateConfig } from './proto/interfaces';
 
 import * as pbjs from 'protobufjs';
@@ -10,6 +10,10 @@ const builder = pbjs.Root.fromJSON(PROTO_DEFINITIONS);
 export const Config: pbjs.Type = <any>builder.lookup('stream.Config');
 // tslint:disable-next-line
 export const RateConfig: pbjs.Type = <any>builder.lookup('stream.RateConfig');
+// tslint:disable-next-line
+export const RetentionConfig: pbjs.Type = <any>builder.lookup('stream.RetentionConfig');
+// tslint:disable-next-line
+export const RetentionTier: pbjs.Type = <any>builder.lookup('stream.RetentionTier');
 
 export function DefaultStreamConfig(): IConfig {
   return {
@@ -10,6 +10,10 @@ export const PROTO_DEFINITIONS = {
             "recordRate": {
               "type": "RateConfig",
               "id": 1
+            },
+            "retention": {
+              "type": "RetentionConfig",
+              "id": 2
             }
           }
         },
@@ -24,6 +28,35 @@ export const PROTO_DEFINITIONS = {
               "id": 2
             }
           }
+        },
+        "RetentionConfig": {
+          "fields": {
+            "tiers": {
+              "rule": "repeated",
+              "type": "RetentionTier",
+              "id": 1
+            },
+            "maxAge": {
+              "type": "int64",
+              "id": 2
+            }
+          }
+        },
+        "RetentionTier": {
+          "fields": {
+            "minAge": {
+              "type": "int64",
+              "id": 1
+            },
+            "recordRate": {
+              "type": "RateConfig",
+              "id": 2
+            },
+            "snapshotsOnly": {
+              "type": "bool",
+              "id": 3
+            }
+          }
         }
       }
     }
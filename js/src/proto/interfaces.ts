@@ -1,8 +1,20 @@
 export interface IConfig {
   recordRate?: IRateConfig;
+  retention?: IRetentionConfig;
 }
 
 export interface IRateConfig {
   keyframeFrequency?: number;
   changeFrequency?: number;
 }
+
+export interface IRetentionConfig {
+  tiers?: IRetentionTier[];
+  maxAge?: number;
+}
+
+export interface IRetentionTier {
+  minAge?: number;
+  recordRate?: IRateConfig;
+  snapshotsOnly?: boolean;
+}
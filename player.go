@@ -0,0 +1,310 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Replays a stream in wall-clock time, scaled by a speed multiplier.
+// The state is sent on the States channel each time playback passes an entry,
+// and after a seek. Playing forward the state is sent with the timestamp of
+// the entry passed, playing backwards with the timestamp of the entry before
+// it, the one the state was computed at. Playback pauses at either end of the stream.
+type Player struct {
+	cursor  *Cursor
+	storage StorageBackend
+	states  chan *TimestampedState
+
+	// Playback position at anchorTime, guarded by mtx
+	position   time.Time
+	anchorTime time.Time
+	speed      float64
+	paused     bool
+	reverse    bool
+	seekTo     *time.Time
+	mtx        sync.Mutex
+
+	// Wall-clock time source
+	now func() time.Time
+
+	// Wakes the playback loop after a change
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// Error that stopped playback
+	err     error
+	errLock sync.Mutex
+}
+
+// Start playing the stream from start at speed, e.g. 0.5, 1 or 10.
+func (s *Stream) NewPlayer(start time.Time, speed float64) (*Player, error) {
+	return s.newPlayer(start, speed, time.Now)
+}
+
+func (s *Stream) newPlayer(start time.Time, speed float64, now func() time.Time) (*Player, error) {
+	if speed <= 0 {
+		return nil, errors.New("Speed must be > 0.")
+	}
+	p := &Player{
+		cursor:     s.BuildCursor(ReadBidirectionalCursor),
+		storage:    s.storage,
+		states:     make(chan *TimestampedState, 1),
+		position:   start,
+		anchorTime: now(),
+		speed:      speed,
+		seekTo:     &start,
+		now:        now,
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+// States as playback passes entries. Closed when the player stops.
+func (p *Player) States() <-chan *TimestampedState {
+	return p.states
+}
+
+// Get the current playback position.
+func (p *Player) Position() time.Time {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.positionAt(p.now())
+}
+
+// Note: Lock mtx before calling
+func (p *Player) positionAt(now time.Time) time.Time {
+	if p.paused {
+		return p.position
+	}
+	elapsed := time.Duration(float64(now.Sub(p.anchorTime)) * p.speed)
+	if p.reverse {
+		return p.position.Add(-elapsed)
+	}
+	return p.position.Add(elapsed)
+}
+
+// Change playback settings from the current position.
+func (p *Player) update(cb func()) {
+	p.mtx.Lock()
+	now := p.now()
+	p.position = p.positionAt(now)
+	p.anchorTime = now
+	cb()
+	p.mtx.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Pause playback at the current position.
+func (p *Player) Pause() {
+	p.update(func() {
+		p.paused = true
+	})
+}
+
+// Resume playback from the current position.
+func (p *Player) Resume() {
+	p.update(func() {
+		p.paused = false
+	})
+}
+
+// Jump to a timestamp. The state there is sent, if the stream has data there.
+func (p *Player) Seek(timestamp time.Time) {
+	p.update(func() {
+		p.position = timestamp
+		p.seekTo = &timestamp
+	})
+}
+
+// Set the speed multiplier, ignored if not > 0.
+func (p *Player) SetSpeed(speed float64) {
+	if speed <= 0 {
+		return
+	}
+	p.update(func() {
+		p.speed = speed
+	})
+}
+
+// Play backwards if reverse is set.
+func (p *Player) SetReverse(reverse bool) {
+	p.update(func() {
+		p.reverse = reverse
+	})
+}
+
+// Stop playback. The States channel is closed.
+func (p *Player) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+// Get the error that stopped playback, if any.
+func (p *Player) Error() error {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	return p.err
+}
+
+func (p *Player) run() {
+	defer close(p.states)
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		wait, again, err := p.advance()
+		if err != nil {
+			p.errLock.Lock()
+			p.err = err
+			p.errLock.Unlock()
+			return
+		}
+
+		var timerCh <-chan time.Time
+		if again {
+			select {
+			case <-p.stop:
+				return
+			default:
+				continue
+			}
+		}
+		if wait > 0 {
+			timer.Reset(wait)
+			timerCh = timer.C
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-p.wake:
+		case <-timerCh:
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+// Do the next step of playback. Returns if there is more to do straight
+// away, otherwise how long until the next entry, or zero when paused.
+func (p *Player) advance() (time.Duration, bool, error) {
+	p.mtx.Lock()
+	seekTo := p.seekTo
+	p.seekTo = nil
+	paused, reverse, speed := p.paused, p.reverse, p.speed
+	position := p.positionAt(p.now())
+	p.mtx.Unlock()
+
+	if seekTo != nil {
+		return 0, true, p.seek(*seekTo)
+	}
+	if paused {
+		return 0, false, nil
+	}
+
+	delay, err := p.delayToNextEntry(position, reverse, speed)
+	if err == NoMoreEntriesError {
+		// Pause at the end, or the start when playing backwards.
+		p.update(func() {
+			p.paused = true
+		})
+		return 0, true, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if delay > 0 {
+		return delay, false, nil
+	}
+	return 0, true, p.step(reverse)
+}
+
+// Get the wall-clock time until playback reaches the next entry.
+func (p *Player) delayToNextEntry(position time.Time, reverse bool, speed float64) (time.Duration, error) {
+	var distance time.Duration
+	if reverse {
+		// The state changes when playback passes the entry it is at.
+		if !p.cursor.Ready() {
+			return 0, NoMoreEntriesError
+		}
+		distance = position.Sub(p.cursor.ComputedTimestamp())
+	} else {
+		entry, err := p.storage.GetEntryAfter(p.cursor.Timestamp(), StreamEntryAny)
+		if err != nil {
+			return 0, err
+		}
+		if entry == nil {
+			return 0, NoMoreEntriesError
+		}
+		distance = entry.Timestamp.Sub(position)
+	}
+	return time.Duration(float64(distance) / speed), nil
+}
+
+// Move the cursor one entry and send the state.
+func (p *Player) step(reverse bool) error {
+	if !reverse {
+		timestamp, state, err := p.cursor.Next()
+		if err != nil {
+			return err
+		}
+		p.emit(timestamp, state)
+		return nil
+	}
+
+	// Move to just before the entry, so the cursor rewinds over it to the
+	// entry before, and send the state with that entry's timestamp.
+	p.cursor.SetTimestamp(p.cursor.ComputedTimestamp().Add(-time.Nanosecond))
+	if err := p.cursor.ComputeState(); err != nil {
+		if err == NoDataError {
+			return nil
+		}
+		return err
+	}
+	state, err := p.cursor.State()
+	if err != nil {
+		return err
+	}
+	p.emit(p.cursor.ComputedTimestamp(), state)
+	return nil
+}
+
+// Move the cursor to timestamp and send the state there.
+func (p *Player) seek(timestamp time.Time) error {
+	cursor := p.cursor
+	cursor.SetTimestamp(timestamp)
+	if err := cursor.ComputeState(); err != nil {
+		if err == NoDataError {
+			return nil
+		}
+		return err
+	}
+	state, err := cursor.State()
+	if err != nil {
+		return err
+	}
+	p.emit(timestamp, state)
+	return nil
+}
+
+// Send a copy of a state, unless the player is stopped.
+func (p *Player) emit(timestamp time.Time, state StateData) {
+	select {
+	case p.states <- &TimestampedState{Timestamp: timestamp, State: CloneStateData(state).StateData}:
+	case <-p.stop:
+	}
+}
@@ -0,0 +1,104 @@
+package stream
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock that only moves when told to.
+type manualClock struct {
+	now time.Time
+	mtx sync.Mutex
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	c.now = c.now.Add(d)
+	c.mtx.Unlock()
+}
+
+func TestPlayer(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	stream, _ := buildTestStream(t, start)
+
+	clock := &manualClock{now: time.Now()}
+	player, err := stream.newPlayer(start.Add(time.Second), 1, clock.Now)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer player.Stop()
+
+	// Move the clock and wake the playback loop.
+	tick := func(d time.Duration) {
+		clock.Advance(d)
+		select {
+		case player.wake <- struct{}{}:
+		default:
+		}
+	}
+	next := func() *TimestampedState {
+		select {
+		case state, ok := <-player.States():
+			if !ok {
+				t.Fatalf("Player stopped: %v", player.Error())
+			}
+			return state
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a state.")
+		}
+		return nil
+	}
+	checkState := func(state *TimestampedState, timestamp time.Time, value int) {
+		if !state.Timestamp.Equal(timestamp) || state.State["test"] != float64(value) {
+			t.Fatalf("Unexpected state %v at %v, expected %d at %v.", state.State, state.Timestamp, value, timestamp)
+		}
+	}
+
+	// The state at the start, then each entry, 2 seconds apart.
+	checkState(next(), start.Add(time.Second), 0)
+	tick(time.Second)
+	checkState(next(), start.Add(2*time.Second), 1)
+	for i := 2; i < 5; i++ {
+		tick(2 * time.Second)
+		checkState(next(), start.Add(time.Duration(i*2)*time.Second), i)
+	}
+
+	player.Pause()
+	player.Seek(start.Add(101 * time.Second))
+	checkState(next(), start.Add(101*time.Second), 50)
+	tick(time.Minute)
+	select {
+	case state := <-player.States():
+		t.Fatalf("Paused player sent a state at %v.", state.Timestamp)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if position := player.Position(); !position.Equal(start.Add(101 * time.Second)) {
+		t.Fatalf("Paused player moved to %v.", position)
+	}
+
+	// Play backwards at double speed, across the snapshot at 60 seconds.
+	// Passing the entry at 100 seconds sends the state at the entry before.
+	player.SetReverse(true)
+	player.SetSpeed(2)
+	player.Resume()
+	tick(500 * time.Millisecond)
+	checkState(next(), start.Add(98*time.Second), 49)
+	for i := 48; i > 25; i-- {
+		tick(time.Second)
+		checkState(next(), start.Add(time.Duration(i*2)*time.Second), i)
+	}
+
+	player.Stop()
+	for range player.States() {
+	}
+	if err := player.Error(); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
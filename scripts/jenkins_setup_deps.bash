@@ -9,7 +9,9 @@ mkdir -p ./goworkspace/src/github.com/fuserobotics
 ln -fs $(pwd) ./goworkspace/src/github.com/fuserobotics/statestream
 
 pushd ./goworkspace/src/github.com/fuserobotics/statestream
-go get -d -v ./
+# -t fetches test-only dependencies, like the go-sqlite3 driver used by the
+# sqlite tests. That driver needs cgo and a C compiler on the agent.
+go get -d -t -v ./...
 popd
 
 set -x
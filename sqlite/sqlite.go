@@ -0,0 +1,482 @@
+// Package sqlite implements a stream storage backend on a SQL database using
+// the SQLite dialect. The driver is chosen by the caller when opening the *sql.DB.
+// The tests use github.com/mattn/go-sqlite3, which requires cgo.
+//
+// Entries for every stream live in the stream_entries table, with the entry
+// data stored as json so history can be queried with ad-hoc SQL.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/statestream"
+)
+
+// Schema migrations, applied in order. Index + 1 is the schema version.
+var migrations = []string{
+	`CREATE TABLE stream_entries (
+		stream_id TEXT NOT NULL,
+		timestamp INTEGER NOT NULL,
+		type INTEGER NOT NULL,
+		data TEXT NOT NULL,
+		PRIMARY KEY (stream_id, timestamp, type)
+	);
+	CREATE INDEX stream_entries_type ON stream_entries (stream_id, type, timestamp);`,
+}
+
+// Number of entries read per query in ForEachEntry
+const forEachPageSize = 100
+
+// A database holding many streams.
+type Database struct {
+	db *sql.DB
+
+	// In-process EntryAdded subscribers by stream ID
+	subscribers    map[string][]chan<- *stream.StreamEntry
+	subscribersMtx sync.RWMutex
+}
+
+// Wrap db, migrating the schema to the latest version.
+func Open(db *sql.DB) (*Database, error) {
+	if err := Migrate(db); err != nil {
+		return nil, err
+	}
+	return &Database{
+		db:          db,
+		subscribers: make(map[string][]chan<- *stream.StreamEntry),
+	}, nil
+}
+
+// Get the schema version of db, 0 if no migrations have been applied.
+func SchemaVersion(db *sql.DB) (int, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// Apply any migrations db is missing, each in its own transaction.
+func Migrate(db *sql.DB) error {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return errors.New("Database schema is newer than this version supports.")
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM schema_version`); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version (version) VALUES (?)`, version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the storage backend for the stream with the ID.
+func (d *Database) Stream(streamId string) *Backend {
+	return &Backend{database: d, streamId: streamId}
+}
+
+// Open the storage backend for the stream with the ID.
+// Streams are created by their first entry.
+func (d *Database) OpenStream(streamId string) (stream.StorageBackend, error) {
+	if streamId == "" {
+		return nil, errors.New("Stream ID must be defined.")
+	}
+	return d.Stream(streamId), nil
+}
+
+// List the IDs of every stream with entries.
+func (d *Database) ListStreams() ([]string, error) {
+	rows, err := d.db.Query(`SELECT DISTINCT stream_id FROM stream_entries ORDER BY stream_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Delete every entry of the stream with the ID.
+func (d *Database) DeleteStream(streamId string) error {
+	_, err := d.db.Exec(`DELETE FROM stream_entries WHERE stream_id = ?`, streamId)
+	return err
+}
+
+func (d *Database) notify(streamId string, entry *stream.StreamEntry) {
+	d.subscribersMtx.RLock()
+	defer d.subscribersMtx.RUnlock()
+
+	for _, sub := range d.subscribers[streamId] {
+		select {
+		case sub <- entry:
+		default:
+		}
+	}
+}
+
+// A storage backend for a single stream in a Database.
+type Backend struct {
+	database *Database
+	streamId string
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEntry(row rowScanner) (*stream.StreamEntry, error) {
+	var timestamp int64
+	var entryType int
+	var data string
+	if err := row.Scan(&timestamp, &entryType, &data); err != nil {
+		return nil, err
+	}
+	entry := &stream.StreamEntry{
+		Timestamp: time.Unix(0, timestamp),
+		Type:      stream.StreamEntryType(entryType),
+	}
+	if err := json.Unmarshal([]byte(data), &entry.Data); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (b *Backend) queryEntry(ctx context.Context, query string, args ...interface{}) (*stream.StreamEntry, error) {
+	entry, err := scanEntry(b.database.db.QueryRowContext(ctx, query, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return entry, err
+}
+
+// Retrieve the first snapshot before timestamp. Return nil for no data.
+func (b *Backend) GetSnapshotBefore(timestamp time.Time) (*stream.StreamEntry, error) {
+	return b.GetSnapshotBeforeContext(context.Background(), timestamp)
+}
+
+// Retrieve the first snapshot before timestamp, with a context for the query.
+func (b *Backend) GetSnapshotBeforeContext(ctx context.Context, timestamp time.Time) (*stream.StreamEntry, error) {
+	return b.queryEntry(ctx,
+		`SELECT timestamp, type, data FROM stream_entries
+		WHERE stream_id = ? AND type = ? AND timestamp < ?
+		ORDER BY timestamp DESC LIMIT 1`,
+		b.streamId, int(stream.StreamEntrySnapshot), timestamp.UnixNano(),
+	)
+}
+
+// Get the next entry after the timestamp. Return nil for no data.
+// Filter by the filter type, or don't filter if StreamEntryAny
+func (b *Backend) GetEntryAfter(timestamp time.Time, filterType stream.StreamEntryType) (*stream.StreamEntry, error) {
+	return b.GetEntryAfterContext(context.Background(), timestamp, filterType)
+}
+
+// Get the next entry after the timestamp, with a context for the query.
+func (b *Backend) GetEntryAfterContext(ctx context.Context, timestamp time.Time, filterType stream.StreamEntryType) (*stream.StreamEntry, error) {
+	if filterType == stream.StreamEntryAny {
+		return b.queryEntry(ctx,
+			`SELECT timestamp, type, data FROM stream_entries
+			WHERE stream_id = ? AND timestamp > ?
+			ORDER BY timestamp ASC LIMIT 1`,
+			b.streamId, timestamp.UnixNano(),
+		)
+	}
+	return b.queryEntry(ctx,
+		`SELECT timestamp, type, data FROM stream_entries
+		WHERE stream_id = ? AND type = ? AND timestamp > ?
+		ORDER BY timestamp ASC LIMIT 1`,
+		b.streamId, int(filterType), timestamp.UnixNano(),
+	)
+}
+
+// Get the entries after from and at or before to, in order.
+func (b *Backend) GetEntriesBetween(from, to time.Time, filterType stream.StreamEntryType, limit int) ([]*stream.StreamEntry, error) {
+	return b.GetEntriesBetweenContext(context.Background(), from, to, filterType, limit)
+}
+
+// Get the entries after from and at or before to, with a context for the query.
+func (b *Backend) GetEntriesBetweenContext(ctx context.Context, from, to time.Time, filterType stream.StreamEntryType, limit int) ([]*stream.StreamEntry, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	query := `SELECT timestamp, type, data FROM stream_entries
+		WHERE stream_id = ? AND timestamp > ? AND timestamp <= ?
+		ORDER BY timestamp ASC, type ASC LIMIT ?`
+	args := []interface{}{b.streamId, from.UnixNano(), to.UnixNano(), limit}
+	if filterType != stream.StreamEntryAny {
+		query = `SELECT timestamp, type, data FROM stream_entries
+			WHERE stream_id = ? AND type = ? AND timestamp > ? AND timestamp <= ?
+			ORDER BY timestamp ASC LIMIT ?`
+		args = []interface{}{b.streamId, int(filterType), from.UnixNano(), to.UnixNano(), limit}
+	}
+	return b.queryEntries(ctx, query, args...)
+}
+
+func (b *Backend) queryEntries(ctx context.Context, query string, args ...interface{}) ([]*stream.StreamEntry, error) {
+	rows, err := b.database.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []*stream.StreamEntry
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, entry)
+	}
+	return res, rows.Err()
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (b *Backend) insertEntry(ctx context.Context, db execer, entry *stream.StreamEntry) error {
+	data, err := json.Marshal(entry.Data)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx,
+		`INSERT INTO stream_entries (stream_id, timestamp, type, data) VALUES (?, ?, ?, ?)`,
+		b.streamId, entry.Timestamp.UnixNano(), int(entry.Type), string(data),
+	)
+	return err
+}
+
+// Store a stream entry.
+func (b *Backend) SaveEntry(entry *stream.StreamEntry) error {
+	return b.SaveEntryContext(context.Background(), entry)
+}
+
+// Store a stream entry, with a context for the query.
+func (b *Backend) SaveEntryContext(ctx context.Context, entry *stream.StreamEntry) error {
+	if err := b.insertEntry(ctx, b.database.db, entry); err != nil {
+		return err
+	}
+	b.database.notify(b.streamId, entry)
+	return nil
+}
+
+// Store the entries in one transaction. An entry replaces any entry at the same timestamp.
+func (b *Backend) SaveEntries(entries []*stream.StreamEntry) error {
+	ctx := context.Background()
+	tx, err := b.database.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		_, err := tx.ExecContext(ctx,
+			`DELETE FROM stream_entries WHERE stream_id = ? AND timestamp = ?`,
+			b.streamId, entry.Timestamp.UnixNano(),
+		)
+		if err == nil {
+			err = b.insertEntry(ctx, tx, entry)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		b.database.notify(b.streamId, entry)
+	}
+	return nil
+}
+
+// Store the entry if the latest entry matches expectedHead, in one transaction.
+// Open the database with immediate transactions when writing from many processes.
+func (b *Backend) SaveEntryIfHead(entry *stream.StreamEntry, expectedHead *stream.StreamEntry) error {
+	err := b.withHead(expectedHead, func(ctx context.Context, tx *sql.Tx) error {
+		return b.insertEntry(ctx, tx, entry)
+	})
+	if err != nil {
+		return err
+	}
+	b.database.notify(b.streamId, entry)
+	return nil
+}
+
+// Replace the latest entry with entry if it matches expectedHead, in one transaction.
+func (b *Backend) AmendEntryIfHead(entry *stream.StreamEntry, expectedHead *stream.StreamEntry) error {
+	if expectedHead == nil {
+		return errors.New("Cannot amend the head of an empty stream.")
+	}
+	return b.withHead(expectedHead, func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx,
+			`DELETE FROM stream_entries WHERE stream_id = ? AND timestamp = ?`,
+			b.streamId, expectedHead.Timestamp.UnixNano(),
+		)
+		if err != nil {
+			return err
+		}
+		return b.insertEntry(ctx, tx, entry)
+	})
+}
+
+// Call cb in a transaction if the latest entry matches expectedHead.
+func (b *Backend) withHead(expectedHead *stream.StreamEntry, cb func(ctx context.Context, tx *sql.Tx) error) error {
+	ctx := context.Background()
+	tx, err := b.database.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	head, err := scanEntry(tx.QueryRowContext(ctx,
+		`SELECT timestamp, type, data FROM stream_entries
+		WHERE stream_id = ? ORDER BY timestamp DESC LIMIT 1`,
+		b.streamId,
+	))
+	if err == sql.ErrNoRows {
+		head, err = nil, nil
+	}
+	if err == nil {
+		err = stream.CheckHead(head, expectedHead)
+	}
+	if err == nil {
+		err = cb(ctx, tx)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Amend an old entry
+func (b *Backend) AmendEntry(entry *stream.StreamEntry, oldTimestamp time.Time) error {
+	return b.AmendEntryContext(context.Background(), entry, oldTimestamp)
+}
+
+// Amend an old entry, with a context for the transaction.
+func (b *Backend) AmendEntryContext(ctx context.Context, entry *stream.StreamEntry, oldTimestamp time.Time) error {
+	tx, err := b.database.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx,
+		`DELETE FROM stream_entries WHERE stream_id = ? AND timestamp = ?`,
+		b.streamId, oldTimestamp.UnixNano(),
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if count, err := res.RowsAffected(); err != nil || count == 0 {
+		tx.Rollback()
+		return err
+	}
+	if err := b.insertEntry(ctx, tx, entry); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Remove the entry at the timestamp
+func (b *Backend) RemoveEntry(timestamp time.Time) error {
+	_, err := b.database.db.Exec(
+		`DELETE FROM stream_entries WHERE stream_id = ? AND timestamp = ?`,
+		b.streamId, timestamp.UnixNano(),
+	)
+	return err
+}
+
+func (b *Backend) EntryAdded(ch chan<- *stream.StreamEntry) {
+	if ch == nil {
+		return
+	}
+
+	b.database.subscribersMtx.Lock()
+	defer b.database.subscribersMtx.Unlock()
+
+	b.database.subscribers[b.streamId] = append(b.database.subscribers[b.streamId], ch)
+}
+
+func (b *Backend) StopEntryAdded(ch chan<- *stream.StreamEntry) {
+	b.database.subscribersMtx.Lock()
+	defer b.database.subscribersMtx.Unlock()
+
+	subs := b.database.subscribers[b.streamId]
+	for i, sub := range subs {
+		if sub == ch {
+			subs = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(b.database.subscribers, b.streamId)
+	} else {
+		b.database.subscribers[b.streamId] = subs
+	}
+}
+
+// Iterate over all entries. Entries are read in pages, so cb may write to the stream.
+func (b *Backend) ForEachEntry(cb func(entry *stream.StreamEntry) error) error {
+	var after int64 = -1 << 63
+	afterType := -1
+	for {
+		page, err := b.readPage(after, afterType)
+		if err != nil {
+			return err
+		}
+		for _, entry := range page {
+			if err := cb(entry); err != nil {
+				return err
+			}
+		}
+		if len(page) < forEachPageSize {
+			return nil
+		}
+		last := page[len(page)-1]
+		after, afterType = last.Timestamp.UnixNano(), int(last.Type)
+	}
+}
+
+// Read the page of entries following the entry at (after, afterType).
+func (b *Backend) readPage(after int64, afterType int) ([]*stream.StreamEntry, error) {
+	return b.queryEntries(context.Background(),
+		`SELECT timestamp, type, data FROM stream_entries
+		WHERE stream_id = ? AND (timestamp > ? OR (timestamp = ? AND type > ?))
+		ORDER BY timestamp ASC, type ASC LIMIT ?`,
+		b.streamId, after, after, afterType, forEachPageSize,
+	)
+}
@@ -0,0 +1,106 @@
+package sqlite
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fuserobotics/statestream"
+	"github.com/fuserobotics/statestream/storagetest"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDatabase(t *testing.T) (*sql.DB, *Database) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "streams.db"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	database, err := Open(db)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return db, database
+}
+
+func TestMigrate(t *testing.T) {
+	db, _ := openTestDatabase(t)
+	defer db.Close()
+
+	// Migrating again should do nothing.
+	if err := Migrate(db); err != nil {
+		t.Fatalf(err.Error())
+	}
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if version != len(migrations) {
+		t.Fatalf("Expected schema version %d, got %d.", len(migrations), version)
+	}
+}
+
+func TestBackendStream(t *testing.T) {
+	db, database := openTestDatabase(t)
+	defer db.Close()
+
+	backend := database.Stream("device-1")
+	added := make(chan *stream.StreamEntry, 10)
+	// A second backend for the same stream should be notified too.
+	database.Stream("device-1").EntryAdded(added)
+
+	strm, err := stream.NewStream(backend, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	now := time.Now()
+	if err := strm.WriteState(now, stream.StateData{"test": 1}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	now = now.Add(time.Duration(2) * time.Second)
+	if err := strm.WriteState(now, stream.StateData{"test": 2}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// Amends the last mutation.
+	if err := strm.WriteState(now.Add(time.Millisecond), stream.StateData{"test": 3}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(added) != 2 {
+		t.Fatalf("Expected 2 added notifications, got %d.", len(added))
+	}
+
+	cursor := strm.BuildCursor(stream.ReadForwardCursor)
+	if err := cursor.Init(now.Add(time.Second)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if state, _ := cursor.State(); state["test"].(float64) != 3 {
+		t.Fatalf("Unexpected state %v.", state)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM stream_entries WHERE json_extract(data, '$.test') = 3`).Scan(&count); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if count != 1 {
+		t.Fatalf("Expected the amended mutation to be queryable, got %d rows.", count)
+	}
+
+	ids, err := database.ListStreams()
+	if err != nil || len(ids) != 1 || ids[0] != "device-1" {
+		t.Fatalf("Unexpected streams %v %v.", ids, err)
+	}
+	if err := database.DeleteStream("device-1"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if entry, err := backend.GetEntryAfter(time.Time{}, stream.StreamEntryAny); err != nil || entry != nil {
+		t.Fatalf("Stream was not deleted.")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) stream.StorageBackend {
+		db, database := openTestDatabase(t)
+		t.Cleanup(func() { db.Close() })
+		return database.Stream("test")
+	})
+}
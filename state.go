@@ -24,6 +24,12 @@ type StreamEntry struct {
 	Data      StateData       `json:"data"`
 }
 
+// The state of a stream at a timestamp.
+type TimestampedState struct {
+	Timestamp time.Time
+	State     StateData
+}
+
 type StateDataPtr struct {
 	StateData
 }
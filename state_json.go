@@ -0,0 +1,46 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Returned when a stored state does not decode into the type of a typed stream,
+// for example after the type changed.
+type StateDecodeError struct {
+	// Timestamp of the state.
+	Timestamp time.Time
+	Err       error
+}
+
+func (e *StateDecodeError) Error() string {
+	return fmt.Sprintf("State at %v does not decode: %v", e.Timestamp, e.Err)
+}
+
+func (e *StateDecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Encode a value to StateData through JSON. It must encode to a JSON object.
+func EncodeState(state interface{}) (StateData, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	var res StateData
+	if err := json.Unmarshal(data, &res); err != nil || res == nil {
+		return nil, errors.New("State must encode to a JSON object.")
+	}
+	return res, nil
+}
+
+// Decode StateData into a value through JSON.
+func DecodeState(data StateData, state interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, state)
+}
@@ -0,0 +1,62 @@
+package stream
+
+import (
+	"errors"
+	"strings"
+)
+
+// Split a dotted path like "sensors.temp" into its keys.
+func splitPath(path string) ([]string, error) {
+	if path == "" {
+		return nil, errors.New("Path must be defined.")
+	}
+	keys := strings.Split(path, ".")
+	for _, key := range keys {
+		if key == "" {
+			return nil, errors.New("Path contains an empty key.")
+		}
+	}
+	return keys, nil
+}
+
+func asObject(val interface{}) (map[string]interface{}, bool) {
+	switch obj := val.(type) {
+	case map[string]interface{}:
+		return obj, true
+	case StateData:
+		return obj, true
+	}
+	return nil, false
+}
+
+// Get the value at path in data, or nil if it is not set.
+func lookupPath(data map[string]interface{}, path []string) interface{} {
+	var val interface{} = data
+	for _, key := range path {
+		obj, ok := asObject(val)
+		if !ok {
+			return nil
+		}
+		val = obj[key]
+	}
+	return val
+}
+
+// Deep copy a JSON-like value.
+func cloneValue(val interface{}) interface{} {
+	if obj, ok := asObject(val); ok {
+		res := make(map[string]interface{}, len(obj))
+		for k, v := range obj {
+			res[k] = cloneValue(v)
+		}
+		return res
+	}
+	if arr, ok := val.([]interface{}); ok {
+		res := make([]interface{}, len(arr))
+		for i, v := range arr {
+			res[i] = cloneValue(v)
+		}
+		return res
+	}
+	return val
+}
@@ -21,4 +21,74 @@ type StorageBackend interface {
 
 type StreamingStorageBackend interface {
 	EntryAdded(chan<- *StreamEntry)
+	// Stop sending added entries to a channel passed to EntryAdded.
+	StopEntryAdded(chan<- *StreamEntry)
+}
+
+type StreamEntryChangeType int
+
+const (
+	StreamEntryAdded StreamEntryChangeType = iota
+	StreamEntryAmended
+	StreamEntryRemoved
+)
+
+// A change to the entries of a stream.
+type StreamEntryChange struct {
+	Type StreamEntryChangeType
+	// The added or amended entry, nil if removed.
+	Entry *StreamEntry
+	// Timestamp of the amended or removed entry.
+	OldTimestamp time.Time
+}
+
+// A storage backend reporting every change to its entries, including the
+// amends made by write cursors.
+type ChangeFeedStorageBackend interface {
+	EntryChanged(chan<- *StreamEntryChange)
+	// Stop sending changes to a channel passed to EntryChanged.
+	StopEntryChanged(chan<- *StreamEntryChange)
+}
+
+// A storage backend that can remove entries, used when re-structuring a stream.
+type PrunableStorageBackend interface {
+	// Remove the entry at the timestamp. Do nothing if there is no entry.
+	RemoveEntry(timestamp time.Time) error
+}
+
+// A storage backend that can return many entries per query.
+// Cursors use this to fast-forward with fewer round trips.
+type RangeStorageBackend interface {
+	// Get the entries after from and at or before to, in order.
+	// Filter by the filter type, or don't filter if StreamEntryAny.
+	// Return at most limit entries, or all entries if limit <= 0.
+	GetEntriesBetween(from, to time.Time, filterType StreamEntryType, limit int) ([]*StreamEntry, error)
+}
+
+// A storage backend holding many streams, keyed by stream ID.
+type MultiStorageBackend interface {
+	// Open the storage for the stream with the ID, creating it if needed.
+	OpenStream(streamId string) (StorageBackend, error)
+	// List the IDs of the streams in storage.
+	ListStreams() ([]string, error)
+	// Delete the stream with the ID. Do nothing if it does not exist.
+	DeleteStream(streamId string) error
+}
+
+// A storage backend that can store many entries atomically.
+type BatchStorageBackend interface {
+	// Store the entries, either all of them or none.
+	// An entry replaces any entry stored at the same timestamp.
+	SaveEntries(entries []*StreamEntry) error
+}
+
+// A storage backend that can write only if the head of the stream is as
+// expected, so several writers can safely share one stream.
+type ConditionalStorageBackend interface {
+	// Store the entry if the latest entry matches expectedHead, or if the
+	// stream is empty and expectedHead is nil. Otherwise return a *ConflictError.
+	SaveEntryIfHead(entry *StreamEntry, expectedHead *StreamEntry) error
+	// Replace the latest entry with entry if it matches expectedHead.
+	// Otherwise return a *ConflictError.
+	AmendEntryIfHead(entry *StreamEntry, expectedHead *StreamEntry) error
 }
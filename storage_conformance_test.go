@@ -0,0 +1,32 @@
+package stream_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/fuserobotics/statestream"
+	"github.com/fuserobotics/statestream/storagetest"
+)
+
+func TestMockStorageBackendConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) stream.StorageBackend {
+		return &stream.MockStorageBackend{}
+	})
+}
+
+func TestMemoryBackendConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) stream.StorageBackend {
+		return &stream.MemoryBackend{}
+	})
+}
+
+func TestFileBackendConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) stream.StorageBackend {
+		fb, err := stream.NewFileBackend(filepath.Join(t.TempDir(), "stream.log"))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		t.Cleanup(func() { fb.Close() })
+		return fb
+	})
+}
@@ -0,0 +1,83 @@
+package stream
+
+import (
+	"context"
+	"time"
+)
+
+// A storage backend accepting a context, for cancellation and deadlines.
+type ContextStorageBackend interface {
+	// Retrieve the first snapshot before timestamp. Return nil for no data.
+	GetSnapshotBeforeContext(ctx context.Context, timestamp time.Time) (*StreamEntry, error)
+	// Get the next entry after the timestamp. Return nil for no data.
+	// Filter by the filter type, or don't filter if StreamEntryAny
+	GetEntryAfterContext(ctx context.Context, timestamp time.Time, filterType StreamEntryType) (*StreamEntry, error)
+	// Store a stream entry.
+	SaveEntryContext(ctx context.Context, entry *StreamEntry) error
+	// Amend an old entry
+	AmendEntryContext(ctx context.Context, entry *StreamEntry, oldTimestamp time.Time) error
+}
+
+// A range storage backend accepting a context.
+type ContextRangeStorageBackend interface {
+	// Get the entries after from and at or before to, in order.
+	GetEntriesBetweenContext(ctx context.Context, from, to time.Time, filterType StreamEntryType, limit int) ([]*StreamEntry, error)
+}
+
+// Wraps a storage backend so it can be called with a context.
+// Backends without context support check the context before each call.
+func WithContext(storage StorageBackend) ContextStorageBackend {
+	if ctxStorage, ok := storage.(ContextStorageBackend); ok {
+		return ctxStorage
+	}
+	return &contextStorageAdapter{storage: storage}
+}
+
+type contextStorageAdapter struct {
+	storage StorageBackend
+}
+
+func (a *contextStorageAdapter) GetSnapshotBeforeContext(ctx context.Context, timestamp time.Time) (*StreamEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.storage.GetSnapshotBefore(timestamp)
+}
+
+func (a *contextStorageAdapter) GetEntryAfterContext(ctx context.Context, timestamp time.Time, filterType StreamEntryType) (*StreamEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.storage.GetEntryAfter(timestamp, filterType)
+}
+
+func (a *contextStorageAdapter) SaveEntryContext(ctx context.Context, entry *StreamEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.storage.SaveEntry(entry)
+}
+
+func (a *contextStorageAdapter) AmendEntryContext(ctx context.Context, entry *StreamEntry, oldTimestamp time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.storage.AmendEntry(entry, oldTimestamp)
+}
+
+// Get entries between from and to with the context, if storage supports range queries.
+func getEntriesBetweenContext(ctx context.Context, storage StorageBackend, from, to time.Time, filterType StreamEntryType, limit int) ([]*StreamEntry, bool, error) {
+	if ctxStorage, ok := storage.(ContextRangeStorageBackend); ok {
+		entries, err := ctxStorage.GetEntriesBetweenContext(ctx, from, to, filterType, limit)
+		return entries, true, err
+	}
+	rangeStorage, ok := storage.(RangeStorageBackend)
+	if !ok {
+		return nil, false, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, true, err
+	}
+	entries, err := rangeStorage.GetEntriesBetween(from, to, filterType, limit)
+	return entries, true, err
+}
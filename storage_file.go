@@ -0,0 +1,1020 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default size at which the active segment is sealed, and of sealed segments.
+const defaultFileSegmentSize = 16 << 20
+
+// Default number of entries between points of a sealed segment's sparse index.
+const defaultFileIndexInterval = 64
+
+// Name of the file listing the segments of a FileBackend.
+const fileManifestName = "MANIFEST"
+
+// Options for a FileBackend, zero fields use the defaults.
+type FileBackendOptions struct {
+	// Size in bytes at which the active segment is sealed.
+	SegmentSize int64
+	// Number of entries between points of a sealed segment's sparse index.
+	IndexInterval int
+}
+
+// A storage backend persisting entries to an append-only segmented log in a directory.
+//
+// Writes are appended to the active segment, amends and removals as records
+// replacing the old entry. The active segment has an in-memory index of its
+// records. Once it reaches the segment size it is sealed: its entries are
+// merged into sorted, immutable segments, rewriting any older segment with
+// entries it replaced. Sealed segments only have a sparse index, a point every
+// IndexInterval entries, so index memory stays small for long streams.
+// The manifest lists the sealed segments, with their indexes, and the active segment.
+type FileBackend struct {
+	// Directory of the log
+	path    string
+	options FileBackendOptions
+
+	// Sealed segments, ordered by timestamp and not overlapping
+	segments []*fileSegment
+	// Active segment
+	file     *os.File
+	fileName string
+	// Offset of the end of the active segment
+	size int64
+	// Entries and removals in the active segment, ordered by timestamp.
+	// They replace the entries at the same timestamp in sealed segments.
+	index []fileIndexEntry
+	// Sequence number of the next segment file
+	nextFile int
+	mtx      sync.RWMutex
+
+	subscribers    []chan<- *StreamEntry
+	subscribersMtx sync.RWMutex
+}
+
+type fileIndexEntry struct {
+	timestamp time.Time
+	entryType StreamEntryType
+	offset    int64
+	// Position of the entry in a batch record
+	batchIndex int
+	// Set if the entry at timestamp was removed
+	removed bool
+}
+
+// A sealed segment, one entry per record, sorted by timestamp.
+type fileSegment struct {
+	fileSegmentInfo
+	file *os.File
+}
+
+// Describes a sealed segment in the manifest.
+type fileSegmentInfo struct {
+	Name  string    `json:"name"`
+	Size  int64     `json:"size"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+	// Offset of the last snapshot, -1 if there is none
+	LastSnapshot int64 `json:"last_snapshot"`
+	// Sparse index, starting with the first entry
+	Index []fileIndexPoint `json:"index"`
+}
+
+type fileIndexPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Offset    int64     `json:"offset"`
+	// Offset of the last snapshot before this point, -1 if there is none
+	Snapshot int64 `json:"snapshot"`
+}
+
+type fileManifest struct {
+	Segments []*fileSegmentInfo `json:"segments"`
+	Active   string             `json:"active"`
+	NextFile int                `json:"next_file"`
+}
+
+type fileRecordOp int
+
+const (
+	fileRecordSave fileRecordOp = iota
+	fileRecordAmend
+	fileRecordRemove
+	fileRecordBatch
+)
+
+// A record in the log. Stored as a big-endian uint32 length followed by json.
+type fileRecord struct {
+	Op           fileRecordOp   `json:"op"`
+	Entry        *StreamEntry   `json:"entry,omitempty"`
+	Entries      []*StreamEntry `json:"entries,omitempty"`
+	OldTimestamp time.Time      `json:"old_timestamp"`
+}
+
+// Opens or creates a log in the directory at path, with the default options.
+func NewFileBackend(path string) (*FileBackend, error) {
+	return NewFileBackendWithOptions(path, nil)
+}
+
+// Opens or creates a log in the directory at path.
+// A partially written record at the end of the active segment is discarded.
+func NewFileBackendWithOptions(path string, options *FileBackendOptions) (*FileBackend, error) {
+	fb := &FileBackend{
+		path: path,
+		options: FileBackendOptions{
+			SegmentSize:   defaultFileSegmentSize,
+			IndexInterval: defaultFileIndexInterval,
+		},
+	}
+	if options != nil {
+		if options.SegmentSize > 0 {
+			fb.options.SegmentSize = options.SegmentSize
+		}
+		if options.IndexInterval > 0 {
+			fb.options.IndexInterval = options.IndexInterval
+		}
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	if err := fb.open(); err != nil {
+		fb.Close()
+		return nil, err
+	}
+	return fb, nil
+}
+
+// Open the files in the manifest, creating it for a new log.
+func (fb *FileBackend) open() error {
+	manifest := &fileManifest{}
+	data, err := os.ReadFile(filepath.Join(fb.path, fileManifestName))
+	created := os.IsNotExist(err)
+	if created {
+		manifest.Active = fb.newFileName(".log")
+		manifest.NextFile = fb.nextFile
+	} else if err != nil {
+		return err
+	} else if err := json.Unmarshal(data, manifest); err != nil {
+		return err
+	}
+	fb.nextFile = manifest.NextFile
+
+	for _, info := range manifest.Segments {
+		file, err := os.Open(filepath.Join(fb.path, info.Name))
+		if err != nil {
+			return err
+		}
+		fb.segments = append(fb.segments, &fileSegment{fileSegmentInfo: *info, file: file})
+	}
+	fb.fileName = manifest.Active
+	fb.file, err = os.OpenFile(filepath.Join(fb.path, fb.fileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if created {
+		if err := fb.writeManifest(fb.segments, fb.fileName); err != nil {
+			return err
+		}
+		syncDir(fb.path)
+	}
+
+	fb.removeUnlisted()
+	return fb.load()
+}
+
+// Remove segment files not in the manifest, left by an interrupted seal.
+func (fb *FileBackend) removeUnlisted() {
+	listed := map[string]bool{fb.fileName: true}
+	for _, seg := range fb.segments {
+		listed[seg.Name] = true
+	}
+	files, err := os.ReadDir(fb.path)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		name := file.Name()
+		unlisted := (strings.HasSuffix(name, ".seg") || strings.HasSuffix(name, ".log")) && !listed[name]
+		if unlisted || name == fileManifestName+".tmp" {
+			os.Remove(filepath.Join(fb.path, name))
+		}
+	}
+}
+
+// Get the name of a new segment file.
+// Note: Lock mtx before calling
+func (fb *FileBackend) newFileName(ext string) string {
+	name := fmt.Sprintf("%08d%s", fb.nextFile, ext)
+	fb.nextFile++
+	return name
+}
+
+// Read the active segment, building its index.
+func (fb *FileBackend) load() error {
+	reader := bufio.NewReader(io.NewSectionReader(fb.file, 0, 1<<62))
+	var offset int64
+	for {
+		record, length, err := readFileRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			// Crashed while writing the last record.
+			if err := fb.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := fb.applyRecord(record, offset); err != nil {
+			return err
+		}
+		offset += length
+	}
+	fb.size = offset
+	return nil
+}
+
+// Read a record, returning the number of bytes read.
+func readFileRecord(reader io.Reader) (*fileRecord, int64, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, 0, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(reader, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	record := &fileRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, 0, err
+	}
+	return record, int64(len(header) + len(data)), nil
+}
+
+// Encode a record with its length.
+func encodeFileRecord(record *fileRecord) ([]byte, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	return buf, nil
+}
+
+// Apply a record at offset to the index.
+// Note: Lock mtx before calling
+func (fb *FileBackend) applyRecord(record *fileRecord, offset int64) error {
+	switch record.Op {
+	case fileRecordSave, fileRecordAmend:
+		if record.Entry == nil {
+			return errors.New("Log contains a record without an entry.")
+		}
+		if record.Op == fileRecordAmend {
+			fb.setIndex(fileIndexEntry{timestamp: record.OldTimestamp, removed: true})
+		}
+		fb.setIndex(fileIndexEntry{
+			timestamp: record.Entry.Timestamp,
+			entryType: record.Entry.Type,
+			offset:    offset,
+		})
+	case fileRecordBatch:
+		// Entries in a batch replace entries at the same timestamp.
+		for i, entry := range record.Entries {
+			fb.setIndex(fileIndexEntry{
+				timestamp:  entry.Timestamp,
+				entryType:  entry.Type,
+				offset:     offset,
+				batchIndex: i,
+			})
+		}
+	case fileRecordRemove:
+		fb.setIndex(fileIndexEntry{timestamp: record.OldTimestamp, removed: true})
+	default:
+		return errors.New("Log contains an unknown record type.")
+	}
+	return nil
+}
+
+// Add or replace the index entry at its timestamp.
+// Note: Lock mtx before calling
+func (fb *FileBackend) setIndex(ent fileIndexEntry) {
+	if idx := fb.findIndex(ent.timestamp); idx != -1 {
+		fb.index[idx] = ent
+		return
+	}
+	idx := fb.searchIndex(ent.timestamp)
+	fb.index = append(fb.index, fileIndexEntry{})
+	copy(fb.index[idx+1:], fb.index[idx:])
+	fb.index[idx] = ent
+}
+
+// Find the smallest index AFTER the timestamp.
+// Note: RLock mtx before calling
+func (fb *FileBackend) searchIndex(timestamp time.Time) int {
+	return sort.Search(len(fb.index), func(i int) bool {
+		return fb.index[i].timestamp.After(timestamp)
+	})
+}
+
+// Find the index of the entry at exactly timestamp, or -1.
+// Note: RLock mtx before calling
+func (fb *FileBackend) findIndex(timestamp time.Time) int {
+	idx := sort.Search(len(fb.index), func(i int) bool {
+		return !fb.index[i].timestamp.Before(timestamp)
+	})
+	if idx == len(fb.index) || !fb.index[idx].timestamp.Equal(timestamp) {
+		return -1
+	}
+	return idx
+}
+
+// Read the entry an index entry of the active segment points to.
+func (fb *FileBackend) readEntry(ent fileIndexEntry) (*StreamEntry, error) {
+	record, _, err := readFileRecord(io.NewSectionReader(fb.file, ent.offset, fb.size-ent.offset))
+	if err != nil {
+		return nil, err
+	}
+	if record.Op == fileRecordBatch {
+		if ent.batchIndex >= len(record.Entries) {
+			return nil, errors.New("Index points past the end of a batch record.")
+		}
+		return record.Entries[ent.batchIndex], nil
+	}
+	if record.Entry == nil {
+		return nil, errors.New("Index points to a record without an entry.")
+	}
+	return record.Entry, nil
+}
+
+// Append a record to the active segment and apply it to the index.
+// A full active segment is sealed first.
+// Note: Lock mtx before calling
+func (fb *FileBackend) appendRecord(record *fileRecord) error {
+	if fb.size >= fb.options.SegmentSize {
+		if err := fb.seal(); err != nil {
+			return err
+		}
+	}
+	buf, err := encodeFileRecord(record)
+	if err != nil {
+		return err
+	}
+	if _, err := fb.file.WriteAt(buf, fb.size); err != nil {
+		return err
+	}
+	if err := fb.file.Sync(); err != nil {
+		return err
+	}
+	offset := fb.size
+	fb.size += int64(len(buf))
+	return fb.applyRecord(record, offset)
+}
+
+// Read the entry in the record at offset.
+func (s *fileSegment) readEntry(offset int64) (*StreamEntry, error) {
+	record, _, err := readFileRecord(io.NewSectionReader(s.file, offset, s.Size-offset))
+	if err != nil {
+		return nil, err
+	}
+	if record.Entry == nil {
+		return nil, errors.New("Segment contains a record without an entry.")
+	}
+	return record.Entry, nil
+}
+
+// Call cb with each entry from the record at offset, until cb returns false.
+// Returns false if cb did.
+func (s *fileSegment) scan(offset int64, cb func(entry *StreamEntry, offset int64) (bool, error)) (bool, error) {
+	reader := bufio.NewReader(io.NewSectionReader(s.file, offset, s.Size-offset))
+	for offset < s.Size {
+		record, length, err := readFileRecord(reader)
+		if err != nil {
+			return false, err
+		}
+		if record.Entry == nil {
+			return false, errors.New("Segment contains a record without an entry.")
+		}
+		if cont, err := cb(record.Entry, offset); !cont || err != nil {
+			return false, err
+		}
+		offset += length
+	}
+	return true, nil
+}
+
+// Get the offset to scan from for the entries after timestamp.
+func (s *fileSegment) offsetAfter(timestamp time.Time) int64 {
+	point := sort.Search(len(s.Index), func(i int) bool {
+		return s.Index[i].Timestamp.After(timestamp)
+	}) - 1
+	if point < 0 {
+		return 0
+	}
+	return s.Index[point].Offset
+}
+
+// Get the entry at timestamp, nil if there is none.
+func (s *fileSegment) entryAt(timestamp time.Time) (*StreamEntry, error) {
+	var res *StreamEntry
+	_, err := s.scan(s.offsetAfter(timestamp), func(entry *StreamEntry, offset int64) (bool, error) {
+		if entry.Timestamp.Equal(timestamp) {
+			res = entry
+		}
+		return !entry.Timestamp.After(timestamp), nil
+	})
+	return res, err
+}
+
+// Get the last snapshot before timestamp, nil if there is none in the segment.
+func (s *fileSegment) snapshotBefore(timestamp time.Time) (*StreamEntry, error) {
+	if s.Last.Before(timestamp) {
+		if s.LastSnapshot < 0 {
+			return nil, nil
+		}
+		return s.readEntry(s.LastSnapshot)
+	}
+	point := sort.Search(len(s.Index), func(i int) bool {
+		return !s.Index[i].Timestamp.Before(timestamp)
+	}) - 1
+	if point < 0 {
+		return nil, nil
+	}
+	snapOffset := s.Index[point].Snapshot
+	_, err := s.scan(s.Index[point].Offset, func(entry *StreamEntry, offset int64) (bool, error) {
+		if !entry.Timestamp.Before(timestamp) {
+			return false, nil
+		}
+		if entry.Type == StreamEntrySnapshot {
+			snapOffset = offset
+		}
+		return true, nil
+	})
+	if err != nil || snapOffset < 0 {
+		return nil, err
+	}
+	return s.readEntry(snapOffset)
+}
+
+// Find the first sealed segment with entries at or after timestamp.
+// Note: RLock mtx before calling
+func (fb *FileBackend) segmentFrom(timestamp time.Time) int {
+	return sort.Search(len(fb.segments), func(i int) bool {
+		return !fb.segments[i].Last.Before(timestamp)
+	})
+}
+
+// Get the last snapshot before timestamp in the sealed segments.
+// Note: RLock mtx before calling
+func (fb *FileBackend) sealedSnapshotBefore(timestamp time.Time) (*StreamEntry, error) {
+	k := fb.segmentFrom(timestamp)
+	if k < len(fb.segments) {
+		snap, err := fb.segments[k].snapshotBefore(timestamp)
+		if snap != nil || err != nil {
+			return snap, err
+		}
+	}
+	for k--; k >= 0; k-- {
+		if seg := fb.segments[k]; seg.LastSnapshot >= 0 {
+			return seg.readEntry(seg.LastSnapshot)
+		}
+	}
+	return nil, nil
+}
+
+// Check if there is an entry at timestamp.
+// Note: RLock mtx before calling
+func (fb *FileBackend) hasEntry(timestamp time.Time) (bool, error) {
+	if idx := fb.findIndex(timestamp); idx != -1 {
+		return !fb.index[idx].removed, nil
+	}
+	k := fb.segmentFrom(timestamp)
+	if k == len(fb.segments) || fb.segments[k].First.After(timestamp) {
+		return false, nil
+	}
+	entry, err := fb.segments[k].entryAt(timestamp)
+	return entry != nil, err
+}
+
+// Call cb with each entry after timestamp, or every entry if after is nil,
+// in order until cb returns false.
+// Note: RLock mtx before calling
+func (fb *FileBackend) scanEntries(after *time.Time, cb func(entry *StreamEntry) (bool, error)) error {
+	i, k := 0, 0
+	if after != nil {
+		i = fb.searchIndex(*after)
+		k = fb.segmentFrom(*after)
+	}
+	// Send the entries of the active segment before a timestamp, all if nil.
+	sendActive := func(before *time.Time) (bool, error) {
+		for ; i < len(fb.index); i++ {
+			ent := fb.index[i]
+			if before != nil && !ent.timestamp.Before(*before) {
+				break
+			}
+			if ent.removed {
+				continue
+			}
+			entry, err := fb.readEntry(ent)
+			if err != nil {
+				return false, err
+			}
+			if cont, err := cb(entry); !cont || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	for ; k < len(fb.segments); k++ {
+		seg := fb.segments[k]
+		var offset int64
+		if after != nil {
+			offset = seg.offsetAfter(*after)
+		}
+		cont, err := seg.scan(offset, func(entry *StreamEntry, _ int64) (bool, error) {
+			if after != nil && !entry.Timestamp.After(*after) {
+				return true, nil
+			}
+			if cont, err := sendActive(&entry.Timestamp); !cont || err != nil {
+				return false, err
+			}
+			// The active segment replaced this entry.
+			if i < len(fb.index) && fb.index[i].timestamp.Equal(entry.Timestamp) {
+				return true, nil
+			}
+			return cb(entry)
+		})
+		if !cont || err != nil {
+			return err
+		}
+	}
+	_, err := sendActive(nil)
+	return err
+}
+
+// Retrieve the first snapshot before timestamp. Return nil for no data.
+func (fb *FileBackend) GetSnapshotBefore(timestamp time.Time) (*StreamEntry, error) {
+	fb.mtx.RLock()
+	defer fb.mtx.RUnlock()
+
+	var active *StreamEntry
+	for i := fb.searchIndex(timestamp) - 1; i >= 0; i-- {
+		ent := fb.index[i]
+		if !ent.removed && ent.entryType == StreamEntrySnapshot && ent.timestamp.Before(timestamp) {
+			var err error
+			if active, err = fb.readEntry(ent); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	// Skip sealed snapshots the active segment replaced.
+	sealed, err := fb.sealedSnapshotBefore(timestamp)
+	for err == nil && sealed != nil && fb.findIndex(sealed.Timestamp) != -1 {
+		sealed, err = fb.sealedSnapshotBefore(sealed.Timestamp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sealed == nil || (active != nil && active.Timestamp.After(sealed.Timestamp)) {
+		return active, nil
+	}
+	return sealed, nil
+}
+
+// Get the next entry after the timestamp. Return nil for no data.
+// Filter by the filter type, or don't filter if StreamEntryAny
+func (fb *FileBackend) GetEntryAfter(timestamp time.Time, filterType StreamEntryType) (*StreamEntry, error) {
+	fb.mtx.RLock()
+	defer fb.mtx.RUnlock()
+
+	var res *StreamEntry
+	err := fb.scanEntries(&timestamp, func(entry *StreamEntry) (bool, error) {
+		if filterType == StreamEntryAny || entry.Type == filterType {
+			res = entry
+			return false, nil
+		}
+		return true, nil
+	})
+	return res, err
+}
+
+// Get the entries after from and at or before to, in order.
+func (fb *FileBackend) GetEntriesBetween(from, to time.Time, filterType StreamEntryType, limit int) ([]*StreamEntry, error) {
+	fb.mtx.RLock()
+	defer fb.mtx.RUnlock()
+
+	var res []*StreamEntry
+	err := fb.scanEntries(&from, func(entry *StreamEntry) (bool, error) {
+		if entry.Timestamp.After(to) {
+			return false, nil
+		}
+		if filterType == StreamEntryAny || entry.Type == filterType {
+			res = append(res, entry)
+		}
+		return limit <= 0 || len(res) < limit, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Store a stream entry.
+func (fb *FileBackend) SaveEntry(entry *StreamEntry) error {
+	fb.mtx.Lock()
+	err := fb.appendRecord(&fileRecord{Op: fileRecordSave, Entry: entry})
+	fb.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	fb.notify(entry)
+	return nil
+}
+
+func (fb *FileBackend) notify(entry *StreamEntry) {
+	fb.subscribersMtx.RLock()
+	defer fb.subscribersMtx.RUnlock()
+
+	for _, sub := range fb.subscribers {
+		select {
+		case sub <- entry:
+		default:
+		}
+	}
+}
+
+// Store the entries as one record, so they are written atomically.
+// An entry replaces any entry at the same timestamp.
+func (fb *FileBackend) SaveEntries(entries []*StreamEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	fb.mtx.Lock()
+	err := fb.appendRecord(&fileRecord{Op: fileRecordBatch, Entries: entries})
+	fb.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		fb.notify(entry)
+	}
+	return nil
+}
+
+// Amend an old entry
+func (fb *FileBackend) AmendEntry(entry *StreamEntry, oldTimestamp time.Time) error {
+	fb.mtx.Lock()
+	defer fb.mtx.Unlock()
+
+	if ok, err := fb.hasEntry(oldTimestamp); !ok || err != nil {
+		return err
+	}
+	return fb.appendRecord(&fileRecord{
+		Op:           fileRecordAmend,
+		Entry:        entry,
+		OldTimestamp: oldTimestamp,
+	})
+}
+
+// Remove the entry at the timestamp
+func (fb *FileBackend) RemoveEntry(timestamp time.Time) error {
+	fb.mtx.Lock()
+	defer fb.mtx.Unlock()
+
+	if ok, err := fb.hasEntry(timestamp); !ok || err != nil {
+		return err
+	}
+	return fb.appendRecord(&fileRecord{
+		Op:           fileRecordRemove,
+		OldTimestamp: timestamp,
+	})
+}
+
+func (fb *FileBackend) EntryAdded(ch chan<- *StreamEntry) {
+	if ch == nil {
+		return
+	}
+
+	fb.subscribersMtx.Lock()
+	defer fb.subscribersMtx.Unlock()
+
+	fb.subscribers = append(fb.subscribers, ch)
+}
+
+func (fb *FileBackend) StopEntryAdded(ch chan<- *StreamEntry) {
+	fb.subscribersMtx.Lock()
+	defer fb.subscribersMtx.Unlock()
+
+	for i, sub := range fb.subscribers {
+		if sub == ch {
+			fb.subscribers = append(fb.subscribers[:i], fb.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (fb *FileBackend) ForEachEntry(cb func(entry *StreamEntry) error) error {
+	fb.mtx.RLock()
+	defer fb.mtx.RUnlock()
+
+	return fb.scanEntries(nil, func(entry *StreamEntry) (bool, error) {
+		return true, cb(entry)
+	})
+}
+
+// Seal the active segment, rewriting the sealed segments it changed without
+// the entries it replaced.
+func (fb *FileBackend) Compact() error {
+	fb.mtx.Lock()
+	defer fb.mtx.Unlock()
+	return fb.seal()
+}
+
+// Merge the active segment into the sealed segments and start a new one.
+// Note: Lock mtx before calling
+func (fb *FileBackend) seal() (sealErr error) {
+	if fb.size == 0 {
+		return nil
+	}
+
+	// Group the active entries by the sealed segment they fall in. Entries
+	// after the last segment go in new segments.
+	groups := make(map[int][]fileIndexEntry)
+	var tail []fileIndexEntry
+	for _, ent := range fb.index {
+		last := len(fb.segments) - 1
+		if last < 0 || ent.timestamp.After(fb.segments[last].Last) {
+			tail = append(tail, ent)
+			continue
+		}
+		k := sort.Search(len(fb.segments), func(i int) bool {
+			return fb.segments[i].First.After(ent.timestamp)
+		}) - 1
+		if k < 0 {
+			k = 0
+		}
+		groups[k] = append(groups[k], ent)
+	}
+
+	// Remove the new files if sealing fails.
+	var created []*fileSegment
+	defer func() {
+		if sealErr != nil {
+			for _, seg := range created {
+				seg.file.Close()
+				os.Remove(filepath.Join(fb.path, seg.Name))
+			}
+		}
+	}()
+
+	var segments, replaced []*fileSegment
+	for k, seg := range fb.segments {
+		ops, ok := groups[k]
+		if !ok {
+			segments = append(segments, seg)
+			continue
+		}
+		entries, err := fb.mergeSegment(seg, ops)
+		if err != nil {
+			return err
+		}
+		written, err := fb.writeSegments(entries)
+		created = append(created, written...)
+		if err != nil {
+			return err
+		}
+		segments = append(segments, written...)
+		replaced = append(replaced, seg)
+	}
+	entries, err := fb.mergeSegment(nil, tail)
+	if err != nil {
+		return err
+	}
+	written, err := fb.writeSegments(entries)
+	created = append(created, written...)
+	if err != nil {
+		return err
+	}
+	segments = append(segments, written...)
+
+	fileName := fb.newFileName(".log")
+	file, err := os.OpenFile(filepath.Join(fb.path, fileName), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	created = append(created, &fileSegment{fileSegmentInfo: fileSegmentInfo{Name: fileName}, file: file})
+	if err := fb.writeManifest(segments, fileName); err != nil {
+		return err
+	}
+
+	// The manifest is replaced, the old files are unused. Keep them if the
+	// rename may not be persisted, they are removed when opening the log.
+	persisted := syncDir(fb.path) == nil
+	for _, seg := range replaced {
+		seg.file.Close()
+		if persisted {
+			os.Remove(filepath.Join(fb.path, seg.Name))
+		}
+	}
+	fb.file.Close()
+	if persisted {
+		os.Remove(filepath.Join(fb.path, fb.fileName))
+	}
+
+	fb.segments = segments
+	fb.file = file
+	fb.fileName = fileName
+	fb.size = 0
+	fb.index = nil
+	return nil
+}
+
+// Merge the entries of a sealed segment, nil for none, with the active
+// entries replacing them, sorted by timestamp.
+// Note: Lock mtx before calling
+func (fb *FileBackend) mergeSegment(seg *fileSegment, ops []fileIndexEntry) ([]*StreamEntry, error) {
+	var res []*StreamEntry
+	i := 0
+	// Add the active entries before a timestamp, all if nil.
+	addOps := func(before *time.Time) error {
+		for ; i < len(ops) && (before == nil || ops[i].timestamp.Before(*before)); i++ {
+			if ops[i].removed {
+				continue
+			}
+			entry, err := fb.readEntry(ops[i])
+			if err != nil {
+				return err
+			}
+			res = append(res, entry)
+		}
+		return nil
+	}
+
+	if seg != nil {
+		_, err := seg.scan(0, func(entry *StreamEntry, _ int64) (bool, error) {
+			if err := addOps(&entry.Timestamp); err != nil {
+				return false, err
+			}
+			if i == len(ops) || !ops[i].timestamp.Equal(entry.Timestamp) {
+				res = append(res, entry)
+			}
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := addOps(nil); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Write entries sorted by timestamp to new sealed segments, split evenly
+// into segments of at most about the segment size.
+// Note: Lock mtx before calling
+func (fb *FileBackend) writeSegments(entries []*StreamEntry) ([]*fileSegment, error) {
+	records := make([][]byte, len(entries))
+	var total int64
+	for i, entry := range entries {
+		buf, err := encodeFileRecord(&fileRecord{Op: fileRecordSave, Entry: entry})
+		if err != nil {
+			return nil, err
+		}
+		records[i] = buf
+		total += int64(len(buf))
+	}
+	segmentCount := (total + fb.options.SegmentSize - 1) / fb.options.SegmentSize
+	if segmentCount == 0 {
+		return nil, nil
+	}
+	targetSize := total / segmentCount
+
+	var res []*fileSegment
+	var seg *fileSegment
+	var writer *bufio.Writer
+	count := 0
+	for i, entry := range entries {
+		if seg == nil {
+			name := fb.newFileName(".seg")
+			file, err := os.OpenFile(filepath.Join(fb.path, name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return res, err
+			}
+			seg = &fileSegment{
+				fileSegmentInfo: fileSegmentInfo{Name: name, LastSnapshot: -1, First: entry.Timestamp},
+				file:            file,
+			}
+			res = append(res, seg)
+			writer = bufio.NewWriter(file)
+			count = 0
+		}
+
+		if count%fb.options.IndexInterval == 0 {
+			seg.Index = append(seg.Index, fileIndexPoint{
+				Timestamp: entry.Timestamp,
+				Offset:    seg.Size,
+				Snapshot:  seg.LastSnapshot,
+			})
+		}
+		if _, err := writer.Write(records[i]); err != nil {
+			return res, err
+		}
+		if entry.Type == StreamEntrySnapshot {
+			seg.LastSnapshot = seg.Size
+		}
+		seg.Size += int64(len(records[i]))
+		seg.Last = entry.Timestamp
+		count++
+
+		if seg.Size >= targetSize || i == len(entries)-1 {
+			if err := writer.Flush(); err != nil {
+				return res, err
+			}
+			if err := seg.file.Sync(); err != nil {
+				return res, err
+			}
+			seg = nil
+		}
+	}
+	return res, nil
+}
+
+// Atomically replace the manifest, syncDir persists the rename.
+// Note: Lock mtx before calling
+func (fb *FileBackend) writeManifest(segments []*fileSegment, active string) error {
+	manifest := &fileManifest{Active: active, NextFile: fb.nextFile}
+	for _, seg := range segments {
+		manifest.Segments = append(manifest.Segments, &seg.fileSegmentInfo)
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(fb.path, fileManifestName+".tmp")
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(fb.path, fileManifestName))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// Sync a directory, persisting renames in it.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Close the log files.
+func (fb *FileBackend) Close() error {
+	fb.mtx.Lock()
+	defer fb.mtx.Unlock()
+
+	for _, seg := range fb.segments {
+		seg.file.Close()
+	}
+	if fb.file == nil {
+		return nil
+	}
+	return fb.file.Close()
+}
@@ -0,0 +1,276 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func buildTestFileBackend(t *testing.T, path string) *FileBackend {
+	fb, err := NewFileBackend(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return fb
+}
+
+// Count the entries in a backend.
+func countEntries(t *testing.T, backend StorageBackend) int {
+	count := 0
+	if err := backend.ForEachEntry(func(entry *StreamEntry) error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	return count
+}
+
+func TestFileBackendPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stream.log")
+	fb := buildTestFileBackend(t, path)
+	for _, entry := range MockEntries() {
+		if err := fb.SaveEntry(entry); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	amended := &StreamEntry{
+		Type:      StreamEntryMutation,
+		Timestamp: TestBaseTime.Add(time.Duration(-1) * time.Second),
+		Data:      StateData{"test": "amended"},
+	}
+	if err := fb.AmendEntry(amended, amended.Timestamp); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := fb.RemoveEntry(TestBaseTime.Add(time.Duration(-2) * time.Second)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := fb.Close(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	fb = buildTestFileBackend(t, path)
+	defer fb.Close()
+	if count := countEntries(t, fb); count != 9 {
+		t.Fatalf("Expected 9 entries after reopening, got %d.", count)
+	}
+	se, err := fb.GetEntryAfter(TestBaseTime.Add(time.Duration(-3)*time.Second), StreamEntryAny)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if se == nil || se.Data["test"] != "amended" {
+		t.Fatalf("Amended entry was not persisted: %v", se)
+	}
+	se, err = fb.GetSnapshotBefore(TestBaseTime.Add(time.Duration(-4) * time.Second))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if se == nil || se.Data["test"].(float64) != 6 {
+		t.Fatalf("Unexpected snapshot before: %v", se)
+	}
+
+	if err := fb.Compact(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if count := countEntries(t, fb); count != 9 {
+		t.Fatalf("Expected 9 entries after compaction, got %d.", count)
+	}
+}
+
+func TestFileBackendCompactTwice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stream.log")
+	fb := buildTestFileBackend(t, path)
+	for _, entry := range MockEntries() {
+		if err := fb.SaveEntry(entry); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := fb.Compact(); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := fb.SaveEntry(&StreamEntry{
+		Type:      StreamEntryMutation,
+		Timestamp: TestBaseTime.Add(time.Second),
+		Data:      StateData{"test": "after"},
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := fb.Close(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	fb = buildTestFileBackend(t, path)
+	defer fb.Close()
+	if expected, count := len(MockEntries())+1, countEntries(t, fb); count != expected {
+		t.Fatalf("Expected %d entries after reopening, got %d.", expected, count)
+	}
+}
+
+func TestFileBackendStream(t *testing.T) {
+	fb := buildTestFileBackend(t, filepath.Join(t.TempDir(), "stream.log"))
+	defer fb.Close()
+
+	stream, err := NewStream(fb, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	now := time.Now()
+	if err := CheckWriteState(stream, `{"test":1}`, now); err != nil {
+		t.Fatalf(err.Error())
+	}
+	now = now.Add(time.Millisecond * time.Duration(1200))
+	if err := CheckWriteState(stream, `{"test":2}`, now); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// Amend the last mutation.
+	if err := CheckWriteState(stream, `{"test":3}`, now.Add(time.Millisecond*time.Duration(10))); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if count := countEntries(t, fb); count != 2 {
+		t.Fatalf("Expected 2 entries, got %d.", count)
+	}
+
+	cursor := stream.BuildCursor(ReadForwardCursor)
+	if err := cursor.Init(now.Add(time.Second)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if data, _ := cursor.State(); data["test"].(float64) != 3 {
+		t.Fatalf("Unexpected state %v.", data)
+	}
+}
+
+func TestFileBackendSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stream")
+	options := &FileBackendOptions{SegmentSize: 1024, IndexInterval: 4}
+	fb, err := NewFileBackendWithOptions(path, options)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// The same operations on a memory backend give the expected results.
+	mb := &MemoryBackend{}
+	backends := []StorageBackend{fb, mb}
+	apply := func(cb func(backend StorageBackend) error) {
+		for _, backend := range backends {
+			if err := cb(backend); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+	}
+	start := time.Now().Truncate(time.Second)
+	entryAt := func(i int, offset time.Duration, data interface{}) *StreamEntry {
+		entry := &StreamEntry{
+			Type:      StreamEntryMutation,
+			Timestamp: start.Add(time.Duration(i)*time.Second + offset),
+			Data:      StateData{"test": data},
+		}
+		if i%7 == 0 {
+			entry.Type = StreamEntrySnapshot
+		}
+		return entry
+	}
+
+	for i := 0; i < 200; i++ {
+		apply(func(backend StorageBackend) error {
+			return backend.SaveEntry(entryAt(i, 0, i))
+		})
+	}
+	// Change entries in sealed segments: late entries, amends and removals.
+	for i := 0; i < 200; i += 9 {
+		apply(func(backend StorageBackend) error {
+			return backend.SaveEntry(entryAt(i, 500*time.Millisecond, fmt.Sprintf("late %d", i)))
+		})
+	}
+	for i := 1; i < 200; i += 13 {
+		apply(func(backend StorageBackend) error {
+			return backend.AmendEntry(entryAt(i, 0, fmt.Sprintf("amended %d", i)), entryAt(i, 0, nil).Timestamp)
+		})
+		apply(func(backend StorageBackend) error {
+			return backend.AmendEntry(entryAt(i+2, 250*time.Millisecond, fmt.Sprintf("moved %d", i+2)), entryAt(i+2, 0, nil).Timestamp)
+		})
+	}
+	for i := 5; i < 200; i += 17 {
+		apply(func(backend StorageBackend) error {
+			return backend.(PrunableStorageBackend).RemoveEntry(entryAt(i, 0, nil).Timestamp)
+		})
+	}
+	encode := func(entry *StreamEntry) string {
+		data, _ := json.Marshal(entry)
+		return string(data)
+	}
+	check := func(call string, fileEntry, memEntry *StreamEntry, err error) {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if (fileEntry == nil) != (memEntry == nil) || (fileEntry != nil && encode(fileEntry) != encode(memEntry)) {
+			t.Fatalf("%s: got %v, expected %v.", call, fileEntry, memEntry)
+		}
+	}
+	compare := func(stage string) {
+		for ts := start.Add(-time.Second); ts.Before(start.Add(202 * time.Second)); ts = ts.Add(250 * time.Millisecond) {
+			fileEntry, err := fb.GetSnapshotBefore(ts)
+			memEntry, _ := mb.GetSnapshotBefore(ts)
+			check(fmt.Sprintf("%s: GetSnapshotBefore(%v)", stage, ts), fileEntry, memEntry, err)
+			for _, filter := range []StreamEntryType{StreamEntryAny, StreamEntrySnapshot} {
+				fileEntry, err = fb.GetEntryAfter(ts, filter)
+				memEntry, _ = mb.GetEntryAfter(ts, filter)
+				check(fmt.Sprintf("%s: GetEntryAfter(%v, %v)", stage, ts, filter), fileEntry, memEntry, err)
+			}
+		}
+		var fileEntries, memEntries []*StreamEntry
+		fb.ForEachEntry(func(entry *StreamEntry) error {
+			fileEntries = append(fileEntries, entry)
+			return nil
+		})
+		mb.ForEachEntry(func(entry *StreamEntry) error {
+			memEntries = append(memEntries, entry)
+			return nil
+		})
+		if len(fileEntries) != len(memEntries) {
+			t.Fatalf("%s: expected %d entries, got %d.", stage, len(memEntries), len(fileEntries))
+		}
+		for i := range fileEntries {
+			check(stage+": ForEachEntry", fileEntries[i], memEntries[i], nil)
+		}
+	}
+	reopen := func() {
+		if err := fb.Close(); err != nil {
+			t.Fatalf(err.Error())
+		}
+		fb, err = NewFileBackendWithOptions(path, options)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		backends[0] = fb
+	}
+
+	// The active segment replaces entries in sealed segments.
+	if len(fb.index) == 0 {
+		t.Fatalf("Expected entries in the active segment.")
+	}
+	compare("active")
+	reopen()
+	compare("reopened")
+	if err := fb.Compact(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	compare("compacted")
+	apply(func(backend StorageBackend) error {
+		return backend.SaveEntry(entryAt(200, 0, 200))
+	})
+	reopen()
+	defer fb.Close()
+	compare("saved")
+
+	if len(fb.segments) < 2 {
+		t.Fatalf("Expected several sealed segments, got %d.", len(fb.segments))
+	}
+	for _, seg := range fb.segments {
+		if len(seg.Index) > (int(options.SegmentSize)/20)/options.IndexInterval+1 {
+			t.Fatalf("Segment %s index is not sparse, %d points.", seg.Name, len(seg.Index))
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package stream
 
 import (
+	"errors"
 	"sort"
 	"sync"
 	"time"
@@ -11,8 +12,9 @@ type MemoryBackend struct {
 	Entries    []*StreamEntry
 	EntriesMtx sync.RWMutex
 
-	subscribers    []chan<- *StreamEntry
-	subscribersMtx sync.RWMutex
+	subscribers       []chan<- *StreamEntry
+	changeSubscribers []chan<- *StreamEntryChange
+	subscribersMtx    sync.RWMutex
 }
 
 // Retrieve the first snapshot before timestamp. Return nil for no data.
@@ -20,16 +22,15 @@ func (mb *MemoryBackend) GetSnapshotBefore(timestamp time.Time) (*StreamEntry, e
 	mb.EntriesMtx.RLock()
 	defer mb.EntriesMtx.RUnlock()
 
-	_, idx := mb.findClosest(timestamp)
+	// Find the smallest index AT OR AFTER the timestamp, or the end.
+	idx := sort.Search(len(mb.Entries), func(i int) bool {
+		return !mb.Entries[i].Timestamp.Before(timestamp)
+	})
 
 	// Go back 1 index, the one we found is AT OR AFTER timestamp.
 	// Thus we need to go back at least 1 to get BEFORE that timestamp.
 	idx--
 
-	if idx < 0 {
-		return nil, nil
-	}
-
 	// Iterate backward in time until we have a entry that matches.
 	for i := idx; i >= 0; i-- {
 		ent := mb.Entries[i]
@@ -46,22 +47,45 @@ func (mb *MemoryBackend) GetEntryAfter(timestamp time.Time, filterType StreamEnt
 	mb.EntriesMtx.RLock()
 	defer mb.EntriesMtx.RUnlock()
 
-	closest, idx := mb.findClosest(timestamp)
-	if closest == nil || filterType == StreamEntryAny {
-		return closest, nil
-	}
+	// Find the smallest index strictly AFTER the timestamp.
+	entryCount := len(mb.Entries)
+	idx := sort.Search(entryCount, func(i int) bool {
+		return mb.Entries[i].Timestamp.After(timestamp)
+	})
 
 	// Iterate forward in time until we have a entry that matches.
-	entryCount := len(mb.Entries)
 	for i := idx; i < entryCount; i++ {
 		ent := mb.Entries[i]
-		if ent.Type == filterType {
+		if filterType == StreamEntryAny || ent.Type == filterType {
 			return ent, nil
 		}
 	}
 	return nil, nil
 }
 
+// Get the entries after from and at or before to, in order.
+func (mb *MemoryBackend) GetEntriesBetween(from, to time.Time, filterType StreamEntryType, limit int) ([]*StreamEntry, error) {
+	mb.EntriesMtx.RLock()
+	defer mb.EntriesMtx.RUnlock()
+
+	entryCount := len(mb.Entries)
+	idx := sort.Search(entryCount, func(i int) bool {
+		return mb.Entries[i].Timestamp.After(from)
+	})
+
+	var res []*StreamEntry
+	for i := idx; i < entryCount && (limit <= 0 || len(res) < limit); i++ {
+		ent := mb.Entries[i]
+		if ent.Timestamp.After(to) {
+			break
+		}
+		if filterType == StreamEntryAny || ent.Type == filterType {
+			res = append(res, ent)
+		}
+	}
+	return res, nil
+}
+
 // Note: RLock EntriesMtx before calling
 func (mb *MemoryBackend) findClosest(timestamp time.Time) (*StreamEntry, int) {
 	entryCount := len(mb.Entries)
@@ -84,19 +108,86 @@ func (mb *MemoryBackend) SaveEntry(entry *StreamEntry) error {
 	mb.EntriesMtx.Lock()
 	defer mb.EntriesMtx.Unlock()
 
-	if mb.Entries == nil || len(mb.Entries) == 0 {
-		mb.Entries = []*StreamEntry{entry}
+	mb.insertEntry(entry, false)
+	mb.notify(entry)
+	return nil
+}
+
+// Store the entries atomically. An entry replaces any entry at the same timestamp.
+func (mb *MemoryBackend) SaveEntries(entries []*StreamEntry) error {
+	mb.EntriesMtx.Lock()
+	defer mb.EntriesMtx.Unlock()
+
+	replaced := make([]bool, len(entries))
+	for i, entry := range entries {
+		replaced[i] = mb.insertEntry(entry, true)
+	}
+	for i, entry := range entries {
+		if replaced[i] {
+			mb.notifyAmended(entry, entry.Timestamp)
+		} else {
+			mb.notify(entry)
+		}
+	}
+	return nil
+}
+
+// Store the entry if the latest entry matches expectedHead.
+func (mb *MemoryBackend) SaveEntryIfHead(entry *StreamEntry, expectedHead *StreamEntry) error {
+	mb.EntriesMtx.Lock()
+	defer mb.EntriesMtx.Unlock()
+
+	if err := CheckHead(mb.head(), expectedHead); err != nil {
+		return err
+	}
+	mb.insertEntry(entry, false)
+	mb.notify(entry)
+	return nil
+}
+
+// Replace the latest entry with entry if it matches expectedHead.
+func (mb *MemoryBackend) AmendEntryIfHead(entry *StreamEntry, expectedHead *StreamEntry) error {
+	mb.EntriesMtx.Lock()
+	defer mb.EntriesMtx.Unlock()
+
+	if err := CheckHead(mb.head(), expectedHead); err != nil {
+		return err
+	}
+	if expectedHead == nil {
+		return errors.New("Cannot amend the head of an empty stream.")
+	}
+	mb.Entries[len(mb.Entries)-1] = entry
+	mb.notifyAmended(entry, expectedHead.Timestamp)
+	return nil
+}
+
+// Note: RLock EntriesMtx before calling
+func (mb *MemoryBackend) head() *StreamEntry {
+	if len(mb.Entries) == 0 {
 		return nil
 	}
+	return mb.Entries[len(mb.Entries)-1]
+}
 
-	_, idx := mb.findClosest(entry.Timestamp)
-	if idx != -1 {
+// Insert an entry in order, optionally replacing an entry at the same timestamp.
+// Returns if an entry was replaced.
+// Note: Lock EntriesMtx before calling
+func (mb *MemoryBackend) insertEntry(entry *StreamEntry, replace bool) bool {
+	closest, idx := mb.findClosest(entry.Timestamp)
+	if idx == -1 {
+		mb.Entries = append(mb.Entries, entry)
+	} else if replace && closest.Timestamp.Equal(entry.Timestamp) {
+		mb.Entries[idx] = entry
+		return true
+	} else {
 		s := mb.Entries
 		mb.Entries = append(s[:idx], append([]*StreamEntry{entry}, s[idx:]...)...)
-	} else {
-		mb.Entries = append(mb.Entries, entry)
 	}
+	return false
+}
 
+// Notify subscribers of an added entry.
+func (mb *MemoryBackend) notify(entry *StreamEntry) {
 	mb.subscribersMtx.RLock()
 	for _, sub := range mb.subscribers {
 		select {
@@ -105,17 +196,68 @@ func (mb *MemoryBackend) SaveEntry(entry *StreamEntry) error {
 		}
 	}
 	mb.subscribersMtx.RUnlock()
-	return nil
+
+	mb.notifyChange(&StreamEntryChange{
+		Type:  StreamEntryAdded,
+		Entry: entry,
+	})
+}
+
+func (mb *MemoryBackend) notifyAmended(entry *StreamEntry, oldTimestamp time.Time) {
+	mb.notifyChange(&StreamEntryChange{
+		Type:         StreamEntryAmended,
+		Entry:        entry,
+		OldTimestamp: oldTimestamp,
+	})
+}
+
+func (mb *MemoryBackend) notifyChange(change *StreamEntryChange) {
+	mb.subscribersMtx.RLock()
+	defer mb.subscribersMtx.RUnlock()
+
+	for _, sub := range mb.changeSubscribers {
+		select {
+		case sub <- change:
+		default:
+		}
+	}
 }
 
 // Amend an old entry
 func (mb *MemoryBackend) AmendEntry(entry *StreamEntry, oldTimestamp time.Time) error {
-	_, idx := mb.findClosest(oldTimestamp)
-	if idx == -1 {
+	mb.EntriesMtx.Lock()
+	defer mb.EntriesMtx.Unlock()
+
+	closest, idx := mb.findClosest(oldTimestamp)
+	if closest == nil || !closest.Timestamp.Equal(oldTimestamp) {
 		return nil
 	}
 
-	mb.Entries[idx] = entry
+	if entry.Timestamp.Equal(oldTimestamp) {
+		mb.Entries[idx] = entry
+	} else {
+		mb.Entries = append(mb.Entries[:idx], mb.Entries[idx+1:]...)
+		mb.insertEntry(entry, false)
+	}
+	mb.notifyAmended(entry, oldTimestamp)
+	return nil
+}
+
+// Remove the entry at the timestamp
+func (mb *MemoryBackend) RemoveEntry(timestamp time.Time) error {
+	mb.EntriesMtx.Lock()
+	defer mb.EntriesMtx.Unlock()
+
+	closest, idx := mb.findClosest(timestamp)
+	if closest == nil || !closest.Timestamp.Equal(timestamp) {
+		return nil
+	}
+
+	mb.Entries = append(mb.Entries[:idx], mb.Entries[idx+1:]...)
+	mb.notifyChange(&StreamEntryChange{
+		Type:         StreamEntryRemoved,
+		OldTimestamp: timestamp,
+	})
 	return nil
 }
 
@@ -130,6 +272,41 @@ func (mb *MemoryBackend) EntryAdded(ch chan<- *StreamEntry) {
 	mb.subscribers = append(mb.subscribers, ch)
 }
 
+func (mb *MemoryBackend) EntryChanged(ch chan<- *StreamEntryChange) {
+	if ch == nil {
+		return
+	}
+
+	mb.subscribersMtx.Lock()
+	defer mb.subscribersMtx.Unlock()
+
+	mb.changeSubscribers = append(mb.changeSubscribers, ch)
+}
+
+func (mb *MemoryBackend) StopEntryAdded(ch chan<- *StreamEntry) {
+	mb.subscribersMtx.Lock()
+	defer mb.subscribersMtx.Unlock()
+
+	for i, sub := range mb.subscribers {
+		if sub == ch {
+			mb.subscribers = append(mb.subscribers[:i], mb.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (mb *MemoryBackend) StopEntryChanged(ch chan<- *StreamEntryChange) {
+	mb.subscribersMtx.Lock()
+	defer mb.subscribersMtx.Unlock()
+
+	for i, sub := range mb.changeSubscribers {
+		if sub == ch {
+			mb.changeSubscribers = append(mb.changeSubscribers[:i], mb.changeSubscribers[i+1:]...)
+			return
+		}
+	}
+}
+
 func (mb *MemoryBackend) ForEachEntry(cb func(entry *StreamEntry) error) error {
 	mb.EntriesMtx.RLock()
 	defer mb.EntriesMtx.RUnlock()
@@ -0,0 +1,56 @@
+package stream
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// A memory backend holding many streams.
+type MemoryMultiBackend struct {
+	streams    map[string]*MemoryBackend
+	streamsMtx sync.Mutex
+}
+
+func NewMemoryMultiBackend() *MemoryMultiBackend {
+	return &MemoryMultiBackend{streams: make(map[string]*MemoryBackend)}
+}
+
+// Open the storage for the stream with the ID, creating it if needed.
+func (mb *MemoryMultiBackend) OpenStream(streamId string) (StorageBackend, error) {
+	if streamId == "" {
+		return nil, errors.New("Stream ID must be defined.")
+	}
+
+	mb.streamsMtx.Lock()
+	defer mb.streamsMtx.Unlock()
+
+	backend, ok := mb.streams[streamId]
+	if !ok {
+		backend = &MemoryBackend{}
+		mb.streams[streamId] = backend
+	}
+	return backend, nil
+}
+
+// List the IDs of the streams, in order.
+func (mb *MemoryMultiBackend) ListStreams() ([]string, error) {
+	mb.streamsMtx.Lock()
+	defer mb.streamsMtx.Unlock()
+
+	ids := make([]string, 0, len(mb.streams))
+	for id := range mb.streams {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Delete the stream with the ID.
+func (mb *MemoryMultiBackend) DeleteStream(streamId string) error {
+	mb.streamsMtx.Lock()
+	defer mb.streamsMtx.Unlock()
+
+	delete(mb.streams, streamId)
+	return nil
+}
@@ -48,3 +48,46 @@ func TestSnapshotBefore(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestEntryAfterExcludesTimestamp(t *testing.T) {
+	entries := MockEntries()
+	mb := &MemoryBackend{Entries: entries}
+	se, _ := mb.GetEntryAfter(entries[2].Timestamp, StreamEntryAny)
+	if se != entries[3] {
+		t.Fatalf("Expected the entry after %v, got %v.", entries[2].Timestamp, se)
+	}
+	se, _ = mb.GetEntryAfter(entries[5].Timestamp, StreamEntrySnapshot)
+	if se != nil {
+		t.Fatalf("Expected no snapshot after the last one, got %v.", se)
+	}
+}
+
+func TestEntryChanged(t *testing.T) {
+	mb := &MemoryBackend{Entries: MockEntries()}
+	changes := make(chan *StreamEntryChange, 10)
+	mb.EntryChanged(changes)
+
+	added := &StreamEntry{Type: StreamEntryMutation, Timestamp: TestBaseTime, Data: StateData{"test": 11}}
+	mb.SaveEntry(added)
+	amended := &StreamEntry{Type: StreamEntryMutation, Timestamp: TestBaseTime, Data: StateData{"test": 12}}
+	mb.AmendEntry(amended, TestBaseTime)
+	mb.RemoveEntry(TestBaseTime)
+	// Amending or removing a missing entry does nothing.
+	mb.AmendEntry(amended, TestBaseTime)
+	mb.RemoveEntry(TestBaseTime)
+
+	expected := []*StreamEntryChange{
+		{Type: StreamEntryAdded, Entry: added},
+		{Type: StreamEntryAmended, Entry: amended, OldTimestamp: TestBaseTime},
+		{Type: StreamEntryRemoved, OldTimestamp: TestBaseTime},
+	}
+	for _, exp := range expected {
+		change := <-changes
+		if change.Type != exp.Type || change.Entry != exp.Entry || !change.OldTimestamp.Equal(exp.OldTimestamp) {
+			t.Fatalf("Expected change %v, got %v.", exp, change)
+		}
+	}
+	if len(changes) != 0 {
+		t.Fatalf("Unexpected extra changes.")
+	}
+}
@@ -0,0 +1,422 @@
+// Package storagetest verifies storage backends against the StorageBackend contract.
+package storagetest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fuserobotics/statestream"
+)
+
+// Builds an empty storage backend for a test.
+// Use t.Cleanup to release any resources.
+type BackendFactory func(t *testing.T) stream.StorageBackend
+
+// Run every conformance test against backends built with factory.
+func RunConformance(t *testing.T, factory BackendFactory) {
+	t.Run("Empty", func(t *testing.T) { testEmpty(t, factory(t)) })
+	t.Run("GetSnapshotBefore", func(t *testing.T) { testGetSnapshotBefore(t, factory(t)) })
+	t.Run("GetEntryAfter", func(t *testing.T) { testGetEntryAfter(t, factory(t)) })
+	t.Run("GetEntriesBetween", func(t *testing.T) { testGetEntriesBetween(t, factory(t)) })
+	t.Run("AmendEntry", func(t *testing.T) { testAmendEntry(t, factory(t)) })
+	t.Run("ForEachEntry", func(t *testing.T) { testForEachEntry(t, factory(t)) })
+	t.Run("EntryAdded", func(t *testing.T) { testEntryAdded(t, factory(t)) })
+	t.Run("RemoveEntry", func(t *testing.T) { testRemoveEntry(t, factory(t)) })
+	t.Run("SaveEntries", func(t *testing.T) { testSaveEntries(t, factory(t)) })
+	t.Run("ConditionalWrites", func(t *testing.T) { testConditionalWrites(t, factory(t)) })
+	t.Run("Cursor", func(t *testing.T) { testCursor(t, factory(t)) })
+}
+
+var baseTime = time.Unix(1483228800, 0)
+
+// Timestamp of the i-th test entry.
+func entryTime(i int) time.Time {
+	return baseTime.Add(time.Duration(i) * time.Second)
+}
+
+// Build the test entries, a snapshot every 5 entries.
+func testEntries() []*stream.StreamEntry {
+	var res []*stream.StreamEntry
+	for i := 0; i < 10; i++ {
+		typ := stream.StreamEntryMutation
+		if i%5 == 0 {
+			typ = stream.StreamEntrySnapshot
+		}
+		res = append(res, &stream.StreamEntry{
+			Type:      typ,
+			Timestamp: entryTime(i),
+			Data:      stream.StateData{"test": fmt.Sprintf("%d", i)},
+		})
+	}
+	return res
+}
+
+func saveTestEntries(t *testing.T, backend stream.StorageBackend) {
+	for _, entry := range testEntries() {
+		if err := backend.SaveEntry(entry); err != nil {
+			t.Fatalf("SaveEntry: %v", err)
+		}
+	}
+}
+
+// Check that entry is the i-th test entry (or nil for -1).
+func checkEntry(t *testing.T, call string, entry *stream.StreamEntry, i int) {
+	if i == -1 {
+		if entry != nil {
+			t.Fatalf("%s: expected no entry, got entry at %v.", call, entry.Timestamp)
+		}
+		return
+	}
+	if entry == nil {
+		t.Fatalf("%s: expected entry %d, got nil.", call, i)
+	}
+	expected := testEntries()[i]
+	if !entry.Timestamp.Equal(expected.Timestamp) || entry.Type != expected.Type ||
+		entry.Data["test"] != expected.Data["test"] {
+		t.Fatalf("%s: expected entry %d, got %v %v %v.", call, i, entry.Timestamp, entry.Type, entry.Data)
+	}
+}
+
+func testEmpty(t *testing.T, backend stream.StorageBackend) {
+	snap, err := backend.GetSnapshotBefore(entryTime(0))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	checkEntry(t, "GetSnapshotBefore", snap, -1)
+	entry, err := backend.GetEntryAfter(time.Time{}, stream.StreamEntryAny)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	checkEntry(t, "GetEntryAfter", entry, -1)
+}
+
+func testGetSnapshotBefore(t *testing.T, backend stream.StorageBackend) {
+	saveTestEntries(t, backend)
+	cases := []struct {
+		timestamp time.Time
+		expected  int
+	}{
+		// The snapshot must be strictly before the timestamp.
+		{entryTime(0), -1},
+		{entryTime(0).Add(time.Nanosecond), 0},
+		{entryTime(4), 0},
+		{entryTime(5), 0},
+		{entryTime(6), 5},
+		{entryTime(100), 5},
+	}
+	for _, c := range cases {
+		snap, err := backend.GetSnapshotBefore(c.timestamp)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		checkEntry(t, fmt.Sprintf("GetSnapshotBefore(%v)", c.timestamp), snap, c.expected)
+	}
+}
+
+func testGetEntryAfter(t *testing.T, backend stream.StorageBackend) {
+	saveTestEntries(t, backend)
+	cases := []struct {
+		timestamp  time.Time
+		filterType stream.StreamEntryType
+		expected   int
+	}{
+		{time.Time{}, stream.StreamEntryAny, 0},
+		// The entry must be strictly after the timestamp.
+		{entryTime(0), stream.StreamEntryAny, 1},
+		{entryTime(0).Add(-time.Nanosecond), stream.StreamEntryAny, 0},
+		{entryTime(0), stream.StreamEntrySnapshot, 5},
+		{entryTime(4), stream.StreamEntryMutation, 6},
+		{entryTime(5), stream.StreamEntrySnapshot, -1},
+		{entryTime(9), stream.StreamEntryAny, -1},
+	}
+	for _, c := range cases {
+		entry, err := backend.GetEntryAfter(c.timestamp, c.filterType)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		checkEntry(t, fmt.Sprintf("GetEntryAfter(%v, %v)", c.timestamp, c.filterType), entry, c.expected)
+	}
+}
+
+func testGetEntriesBetween(t *testing.T, backend stream.StorageBackend) {
+	rangeBackend, ok := backend.(stream.RangeStorageBackend)
+	if !ok {
+		t.Skip("Backend does not implement RangeStorageBackend.")
+	}
+	saveTestEntries(t, backend)
+	cases := []struct {
+		from       time.Time
+		to         time.Time
+		filterType stream.StreamEntryType
+		limit      int
+		expected   []int
+	}{
+		{time.Time{}, entryTime(100), stream.StreamEntryAny, 0, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		// From is exclusive, to is inclusive.
+		{entryTime(0), entryTime(5), stream.StreamEntryAny, 0, []int{1, 2, 3, 4, 5}},
+		{entryTime(0), entryTime(5), stream.StreamEntrySnapshot, 0, []int{5}},
+		{entryTime(0), entryTime(9), stream.StreamEntryMutation, 3, []int{1, 2, 3}},
+		{time.Time{}, entryTime(9), stream.StreamEntrySnapshot, 1, []int{0}},
+		{entryTime(9), entryTime(100), stream.StreamEntryAny, 0, nil},
+	}
+	for _, c := range cases {
+		call := fmt.Sprintf("GetEntriesBetween(%v, %v, %v, %d)", c.from, c.to, c.filterType, c.limit)
+		entries, err := rangeBackend.GetEntriesBetween(c.from, c.to, c.filterType, c.limit)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if len(entries) != len(c.expected) {
+			t.Fatalf("%s: expected %d entries, got %d.", call, len(c.expected), len(entries))
+		}
+		for i, entry := range entries {
+			checkEntry(t, call, entry, c.expected[i])
+		}
+	}
+}
+
+func testAmendEntry(t *testing.T, backend stream.StorageBackend) {
+	saveTestEntries(t, backend)
+	amended := &stream.StreamEntry{
+		Type:      stream.StreamEntryMutation,
+		Timestamp: entryTime(9),
+		Data:      stream.StateData{"test": "amended"},
+	}
+	if err := backend.AmendEntry(amended, entryTime(9)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	entry, err := backend.GetEntryAfter(entryTime(8), stream.StreamEntryAny)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if entry == nil || !entry.Timestamp.Equal(entryTime(9)) || entry.Data["test"] != "amended" {
+		t.Fatalf("Entry was not amended, got %v.", entry)
+	}
+	count := 0
+	backend.ForEachEntry(func(entry *stream.StreamEntry) error {
+		count++
+		return nil
+	})
+	if count != 10 {
+		t.Fatalf("AmendEntry should replace the entry, have %d entries.", count)
+	}
+}
+
+func testForEachEntry(t *testing.T, backend stream.StorageBackend) {
+	// Save out of order, iteration must still be ordered.
+	entries := testEntries()
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := backend.SaveEntry(entries[i]); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	i := 0
+	err := backend.ForEachEntry(func(entry *stream.StreamEntry) error {
+		checkEntry(t, "ForEachEntry", entry, i)
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if i != len(entries) {
+		t.Fatalf("ForEachEntry visited %d of %d entries.", i, len(entries))
+	}
+
+	stopErr := fmt.Errorf("stop")
+	if err := backend.ForEachEntry(func(entry *stream.StreamEntry) error { return stopErr }); err != stopErr {
+		t.Fatalf("ForEachEntry should return the callback error, got %v.", err)
+	}
+}
+
+func testEntryAdded(t *testing.T, backend stream.StorageBackend) {
+	streaming, ok := backend.(stream.StreamingStorageBackend)
+	if !ok {
+		t.Skip("Backend does not implement StreamingStorageBackend.")
+	}
+	ch := make(chan *stream.StreamEntry, 20)
+	streaming.EntryAdded(ch)
+	saveTestEntries(t, backend)
+	for i := 0; i < 10; i++ {
+		select {
+		case entry := <-ch:
+			checkEntry(t, "EntryAdded", entry, i)
+		case <-time.After(time.Second):
+			t.Fatalf("EntryAdded did not deliver entry %d.", i)
+		}
+	}
+
+	streaming.StopEntryAdded(ch)
+	if err := backend.SaveEntry(&stream.StreamEntry{
+		Type:      stream.StreamEntryMutation,
+		Timestamp: entryTime(10),
+		Data:      stream.StateData{"test": 10},
+	}); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+	select {
+	case entry := <-ch:
+		t.Fatalf("EntryAdded delivered entry at %v after StopEntryAdded.", entry.Timestamp)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func testRemoveEntry(t *testing.T, backend stream.StorageBackend) {
+	pruner, ok := backend.(stream.PrunableStorageBackend)
+	if !ok {
+		t.Skip("Backend does not implement PrunableStorageBackend.")
+	}
+	saveTestEntries(t, backend)
+	if err := pruner.RemoveEntry(entryTime(5)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// Removing a missing entry is not an error.
+	if err := pruner.RemoveEntry(entryTime(100)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	entry, err := backend.GetEntryAfter(entryTime(4), stream.StreamEntryAny)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	checkEntry(t, "GetEntryAfter", entry, 6)
+	snap, err := backend.GetSnapshotBefore(entryTime(7))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	checkEntry(t, "GetSnapshotBefore", snap, 0)
+}
+
+func testSaveEntries(t *testing.T, backend stream.StorageBackend) {
+	batch, ok := backend.(stream.BatchStorageBackend)
+	if !ok {
+		t.Skip("Backend does not implement BatchStorageBackend.")
+	}
+	entries := testEntries()
+	if err := batch.SaveEntries(entries[:5]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// The second batch replaces the last entry of the first.
+	entries[4] = &stream.StreamEntry{
+		Type:      stream.StreamEntryMutation,
+		Timestamp: entryTime(4),
+		Data:      stream.StateData{"test": "replaced"},
+	}
+	if err := batch.SaveEntries(entries[4:]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	i := 0
+	err := backend.ForEachEntry(func(entry *stream.StreamEntry) error {
+		if i == 4 {
+			if entry.Data["test"] != "replaced" {
+				t.Fatalf("SaveEntries did not replace entry 4, got %v.", entry.Data)
+			}
+		} else {
+			checkEntry(t, "ForEachEntry", entry, i)
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if i != len(entries) {
+		t.Fatalf("Expected %d entries after SaveEntries, got %d.", len(entries), i)
+	}
+}
+
+func expectConflict(t *testing.T, err error) {
+	t.Helper()
+	if _, ok := err.(*stream.ConflictError); !ok {
+		t.Fatalf("Expected a conflict error, got %v.", err)
+	}
+}
+
+// Write through two Streams sharing the backend.
+func testConditionalWrites(t *testing.T, backend stream.StorageBackend) {
+	if _, ok := backend.(stream.ConditionalStorageBackend); !ok {
+		t.Skip("Backend does not implement ConditionalStorageBackend.")
+	}
+	a, _ := stream.NewStream(backend, nil)
+	b, _ := stream.NewStream(backend, nil)
+	if err := a.InitWriter(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := b.InitWriter(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Both writers expect an empty stream, the second one conflicts.
+	if err := a.WriteStateIfHead(time.Time{}, entryTime(0), stream.StateData{"writer": "a"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	expectConflict(t, b.WriteStateIfHead(time.Time{}, entryTime(0), stream.StateData{"writer": "b"}))
+
+	// Refresh and retry.
+	b.ResetWriter()
+	head, err := b.HeadTimestamp()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !head.Equal(entryTime(0)) {
+		t.Fatalf("Expected head at %v, got %v.", entryTime(0), head)
+	}
+	if err := b.WriteStateIfHead(head, entryTime(10), stream.StateData{"writer": "b"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	expectConflict(t, a.WriteStateIfHead(entryTime(0), entryTime(20), stream.StateData{"writer": "a1"}))
+
+	// Amending the head conflicts with the other writer's amend.
+	a.ResetWriter()
+	amendTime := entryTime(10).Add(500 * time.Millisecond)
+	if err := a.WriteStateIfHead(entryTime(10), amendTime, stream.StateData{"writer": "a2"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	expectConflict(t, b.WriteStateIfHead(entryTime(10), amendTime, stream.StateData{"writer": "b2"}))
+
+	cursor := a.BuildCursor(stream.ReadForwardCursor)
+	if err := cursor.Init(entryTime(100)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if state, _ := cursor.State(); state["writer"] != "a2" {
+		t.Fatalf("Unexpected state %v.", state)
+	}
+}
+
+// Write through a Stream and read back through cursors.
+func testCursor(t *testing.T, backend stream.StorageBackend) {
+	strm, err := stream.NewStream(backend, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 0; i < 150; i++ {
+		if err := strm.WriteState(entryTime(i*2), stream.StateData{"test": fmt.Sprintf("%d", i)}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	for _, cursorType := range []stream.CursorType{stream.ReadForwardCursor, stream.ReadBidirectionalCursor} {
+		cursor := strm.BuildCursor(cursorType)
+		if err := cursor.Init(entryTime(1)); err != nil {
+			t.Fatalf(err.Error())
+		}
+		// Step forward then back through the stream.
+		steps := []int{1, 3, 61, 121, 299, 400, 150, 61}
+		for _, step := range steps {
+			cursor.SetTimestamp(entryTime(step))
+			if err := cursor.ComputeState(); err != nil {
+				t.Fatalf(err.Error())
+			}
+			state, err := cursor.State()
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			i := step / 2
+			if i >= 150 {
+				i = 149
+			}
+			if expected := fmt.Sprintf("%d", i); state["test"] != expected {
+				t.Fatalf("%v cursor at %d: expected %s, got %v.", cursorType, step, expected, state["test"])
+			}
+		}
+	}
+}
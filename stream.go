@@ -1,6 +1,7 @@
 package stream
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"time"
@@ -14,6 +15,16 @@ type Stream struct {
 	// If initialized, keep a cursor of the latest state.
 	writeCursor *Cursor
 	initLock    sync.Mutex
+
+	// Insert writes before the latest entry instead of rejecting them.
+	lateWrites bool
+
+	// Held by writes and by operations rewriting stored entries, such as
+	// retention, so a write never uses a write cursor being replaced.
+	writeLock sync.Mutex
+
+	// Time the retention policy was last applied at.
+	retentionTimestamp time.Time
 }
 
 // Creates a new stream, with a default config if config is nil.
@@ -52,50 +63,109 @@ func (s *Stream) DisableAmends() {
 	}
 }
 
+// Accept writes timestamped before the latest entry.
+// Late states are inserted in place and the following entry is rewritten,
+// so every state at a later timestamp is unchanged.
+// A state at or after an amended head mutation, which holds a later state,
+// still returns LateEntryError.
+func (s *Stream) EnableLateWrites() {
+	s.lateWrites = true
+}
+
 // Initialize the stream for writing.
 // If not called, done automatically at the first write.
 func (s *Stream) InitWriter() error {
+	return s.InitWriterContext(context.Background())
+}
+
+// Initialize the stream for writing, with a context for the storage queries.
+func (s *Stream) InitWriterContext(ctx context.Context) error {
 	s.initLock.Lock()
 	defer s.initLock.Unlock()
+	_, err := s.initWriter(ctx)
+	return err
+}
 
+// Get the write cursor, initializing it if needed.
+// Note: Lock initLock before calling
+func (s *Stream) initWriter(ctx context.Context) (*Cursor, error) {
 	if s.writeCursor != nil {
-		return nil
+		return s.writeCursor, nil
 	}
 	cursor := s.BuildCursor(WriteCursor)
-	if err := cursor.Init(time.Now()); err != nil {
-		return err
+	if err := cursor.InitContext(ctx, time.Now()); err != nil {
+		return nil, err
 	}
 	if !cursor.Ready() {
-		return errors.New("Write cursor not ready after init.")
+		return nil, errors.New("Write cursor not ready after init.")
 	}
 	s.writeCursor = cursor
-	return nil
+	return cursor, nil
 }
 
 // Get the write cursor
 func (s *Stream) WriteCursor() (*Cursor, error) {
-	if s.writeCursor == nil {
-		if err := s.InitWriter(); err != nil {
-			return nil, err
-		}
-	}
-	return s.writeCursor, nil
+	return s.writeCursorContext(context.Background())
+}
+
+func (s *Stream) writeCursorContext(ctx context.Context) (*Cursor, error) {
+	s.initLock.Lock()
+	defer s.initLock.Unlock()
+	return s.initWriter(ctx)
 }
 
 func (c *Stream) WriteState(timestamp time.Time, state StateData) error {
-	cursor, err := c.WriteCursor()
+	return c.WriteStateContext(context.Background(), timestamp, state)
+}
+
+// Write a state, with a context for the storage calls.
+func (c *Stream) WriteStateContext(ctx context.Context, timestamp time.Time, state StateData) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	cursor, err := c.writeCursorContext(ctx)
 	if err != nil {
 		return err
 	}
-	return cursor.WriteState(timestamp, state, c.config.RecordRate)
+	if c.lateWrites {
+		if handled, err := c.writeLateState(ctx, cursor, timestamp, state); handled || err != nil {
+			return err
+		}
+	}
+	return cursor.WriteStateContext(ctx, timestamp, state, c.config.RecordRate)
 }
 
 func (c *Stream) WriteEntry(entry *StreamEntry) error {
-	cursor, err := c.WriteCursor()
+	return c.WriteEntryContext(context.Background(), entry)
+}
+
+// Write an entry, with a context for the storage calls.
+func (c *Stream) WriteEntryContext(ctx context.Context, entry *StreamEntry) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	cursor, err := c.writeCursorContext(ctx)
+	if err != nil {
+		return err
+	}
+	return cursor.WriteEntryContext(ctx, entry, c.config.RecordRate)
+}
+
+// Write several states as one unit, see Cursor.WriteBatch.
+func (c *Stream) WriteBatch(states []*StateWrite) error {
+	return c.WriteBatchContext(context.Background(), states)
+}
+
+// Write several states as one unit, with a context for the writes.
+func (c *Stream) WriteBatchContext(ctx context.Context, states []*StateWrite) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	cursor, err := c.writeCursorContext(ctx)
 	if err != nil {
 		return err
 	}
-	return cursor.WriteEntry(entry, c.config.RecordRate)
+	return cursor.WriteBatchContext(ctx, states, c.config.RecordRate)
 }
 
 // Build a new cursor
@@ -0,0 +1,193 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// A function to aggregate a numeric field with.
+type AggregateFunc int
+
+const (
+	AggregateMin AggregateFunc = iota
+	AggregateMax
+	// Mean of the values held in the window, each counted once.
+	AggregateMean
+	// Mean of the value over time.
+	AggregateTimeWeightedMean
+	// Value at the end of the window.
+	AggregateLast
+)
+
+// The aggregate of a numeric field over [Start, End).
+type AggregateWindow struct {
+	Start time.Time
+	End   time.Time
+	Value float64
+	// False if the field was not numeric in the window.
+	Valid bool
+}
+
+// Aggregate a numeric field at a dotted path over fixed windows in [from, to).
+// The last window is cut short at to. Non-numeric and missing values are
+// skipped. The windows are computed in one pass while replaying the field.
+func (s *Stream) Aggregate(path string, from, to time.Time, window time.Duration, fn AggregateFunc) ([]*AggregateWindow, error) {
+	if window <= 0 {
+		return nil, errors.New("Window must be > 0.")
+	}
+	if !to.After(from) {
+		return nil, errors.New("End of range must be after the start.")
+	}
+	if fn < AggregateMin || fn > AggregateLast {
+		return nil, errors.New("Unknown aggregate function.")
+	}
+
+	agg := &aggregator{fn: fn, to: to, window: window}
+	agg.startWindow(from)
+	err := s.replayPath(path, from, to, func(timestamp time.Time, value interface{}) error {
+		agg.set(timestamp, value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	agg.finish()
+	return agg.windows, nil
+}
+
+// Accumulates windows as values are set, in time order.
+type aggregator struct {
+	fn     AggregateFunc
+	to     time.Time
+	window time.Duration
+
+	windows []*AggregateWindow
+	current *AggregateWindow
+
+	// Current value, valueOk if it is numeric
+	value   float64
+	valueOk bool
+	// When the current value was set, or the window start if later
+	since time.Time
+	// If the value was set in an earlier window, and not counted in this one yet
+	carried bool
+
+	count    int
+	sum      float64
+	weighted float64
+	duration time.Duration
+}
+
+func (a *aggregator) startWindow(start time.Time) {
+	end := start.Add(a.window)
+	if end.After(a.to) {
+		end = a.to
+	}
+	a.current = &AggregateWindow{Start: start, End: end}
+	a.count, a.sum, a.weighted, a.duration = 0, 0, 0, 0
+	a.since = start
+	a.carried = a.valueOk
+}
+
+// Count a value held in the current window.
+func (a *aggregator) add(value float64) {
+	w := a.current
+	switch a.fn {
+	case AggregateMin:
+		if !w.Valid || value < w.Value {
+			w.Value = value
+		}
+	case AggregateMax:
+		if !w.Valid || value > w.Value {
+			w.Value = value
+		}
+	case AggregateMean:
+		a.count++
+		a.sum += value
+		w.Value = a.sum / float64(a.count)
+	}
+	w.Valid = true
+}
+
+// Integrate the current value up to timestamp.
+func (a *aggregator) advance(timestamp time.Time) {
+	if a.valueOk && timestamp.After(a.since) {
+		// A value carried into the window counts once it is held for a while.
+		if a.carried {
+			a.add(a.value)
+			a.carried = false
+		}
+		d := timestamp.Sub(a.since)
+		a.weighted += a.value * d.Seconds()
+		a.duration += d
+	}
+	a.since = timestamp
+}
+
+// Close the current window and start the next, if any.
+func (a *aggregator) endWindow() {
+	a.advance(a.current.End)
+	w := a.current
+	switch a.fn {
+	case AggregateTimeWeightedMean:
+		w.Valid = a.duration > 0
+		if w.Valid {
+			w.Value = a.weighted / a.duration.Seconds()
+		}
+	case AggregateLast:
+		w.Valid = a.valueOk
+		w.Value = 0
+		if w.Valid {
+			w.Value = a.value
+		}
+	}
+	a.windows = append(a.windows, w)
+	a.current = nil
+	if w.End.Before(a.to) {
+		a.startWindow(w.End)
+	}
+}
+
+// Set the value at timestamp.
+func (a *aggregator) set(timestamp time.Time, value interface{}) {
+	for a.current != nil && !timestamp.Before(a.current.End) {
+		a.endWindow()
+	}
+	if a.current == nil {
+		return
+	}
+	a.advance(timestamp)
+	a.carried = false
+	a.value, a.valueOk = toFloat(value)
+	if a.valueOk {
+		a.add(a.value)
+	}
+}
+
+// Close the remaining windows.
+func (a *aggregator) finish() {
+	for a.current != nil {
+		a.endWindow()
+	}
+}
+
+// Convert a JSON-like number to a float64.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,175 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Returned when a conditional write finds the head of the stream was moved
+// by another writer. Refresh with ResetWriter and retry.
+type ConflictError struct {
+	// Head timestamp the write expected, zero for an empty stream.
+	Expected time.Time
+	// Actual head timestamp, zero for an empty stream.
+	Actual time.Time
+}
+
+func (e *ConflictError) Error() string {
+	if e.Expected.Equal(e.Actual) {
+		return fmt.Sprintf("Stream head at %v was amended by another writer.", e.Actual)
+	}
+	return fmt.Sprintf("Stream head is at %v, expected %v.", e.Actual, e.Expected)
+}
+
+// Check that the stored head entry matches expectedHead, for conditional writes.
+// Either may be nil for an empty stream. Returns a *ConflictError on mismatch.
+func CheckHead(head, expectedHead *StreamEntry) error {
+	var headTimestamp, expectedTimestamp time.Time
+	if head != nil {
+		headTimestamp = head.Timestamp
+	}
+	if expectedHead != nil {
+		expectedTimestamp = expectedHead.Timestamp
+	}
+	conflict := &ConflictError{Expected: expectedTimestamp, Actual: headTimestamp}
+	if head == nil || expectedHead == nil {
+		if head != expectedHead {
+			return conflict
+		}
+		return nil
+	}
+	if !head.Timestamp.Equal(expectedHead.Timestamp) || head.Type != expectedHead.Type {
+		return conflict
+	}
+	// Compare the data as it would be stored.
+	if !reflect.DeepEqual(CloneStateData(head.Data).StateData, CloneStateData(expectedHead.Data).StateData) {
+		return conflict
+	}
+	return nil
+}
+
+// Turns the writes of a write cursor into conditional writes on the head it knows.
+type conditionalStorage struct {
+	ContextStorageBackend
+	conditional ConditionalStorageBackend
+	head        *StreamEntry
+}
+
+func (s *conditionalStorage) SaveEntryContext(ctx context.Context, entry *StreamEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.conditional.SaveEntryIfHead(entry, s.head)
+}
+
+func (s *conditionalStorage) AmendEntryContext(ctx context.Context, entry *StreamEntry, oldTimestamp time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.head == nil || !s.head.Timestamp.Equal(oldTimestamp) {
+		return errors.New("Conditional amends must amend the head entry.")
+	}
+	return s.conditional.AmendEntryIfHead(entry, s.head)
+}
+
+// Get the latest entry known to a write cursor, nil if the stream is empty.
+// Note: Lock computeMutex before calling
+func (c *Cursor) head() *StreamEntry {
+	if c.lastState == nil {
+		return nil
+	}
+	if c.lastMutation != nil {
+		return c.lastMutation
+	}
+	return c.lastSnapshot
+}
+
+// Get the timestamp of the latest entry, zero if the stream is empty.
+func (c *Cursor) HeadTimestamp() (time.Time, error) {
+	c.computeMutex.Lock()
+	defer c.computeMutex.Unlock()
+
+	if c.cursorType != WriteCursor || !c.ready {
+		return time.Time{}, errors.New("Cursor is not ready, or is not a write cursor.")
+	}
+	if head := c.head(); head != nil {
+		return head.Timestamp, nil
+	}
+	return time.Time{}, nil
+}
+
+// Writes a state if the head of the stream is at expectedHead, zero for an empty stream.
+// The storage must be a ConditionalStorageBackend, which checks the head again
+// when writing. Returns a *ConflictError if another writer moved the head.
+func (c *Cursor) WriteStateIfHead(expectedHead time.Time, timestamp time.Time, state StateData, config *RateConfig) (writeError error) {
+	return c.WriteStateIfHeadContext(context.Background(), expectedHead, timestamp, state, config)
+}
+
+// Writes a state if the head of the stream is at expectedHead, with a context for the storage calls.
+func (c *Cursor) WriteStateIfHeadContext(ctx context.Context, expectedHead time.Time, timestamp time.Time, state StateData, config *RateConfig) (writeError error) {
+	conditional, ok := c.storage.(ConditionalStorageBackend)
+	if !ok {
+		return errors.New("Storage backend does not support conditional writes.")
+	}
+
+	c.computeMutex.Lock()
+	subs := c.entrySubscribers()
+	var savedEntry *StreamEntry
+	defer func() {
+		if writeError == nil && savedEntry != nil {
+			sendEntry(subs, savedEntry)
+		}
+	}()
+	defer c.computeMutex.Unlock()
+
+	if err := c.canHandleNewEntry(timestamp); err != nil {
+		return err
+	}
+	head := c.head()
+	var headTimestamp time.Time
+	if head != nil {
+		headTimestamp = head.Timestamp
+	}
+	if !headTimestamp.Equal(expectedHead) {
+		return &ConflictError{Expected: expectedHead, Actual: headTimestamp}
+	}
+
+	storage := &conditionalStorage{
+		ContextStorageBackend: WithContext(c.storage),
+		conditional:           conditional,
+		head:                  head,
+	}
+	savedEntry, writeError = c.writeState(ctx, storage, timestamp, state, config)
+	return writeError
+}
+
+// Get the timestamp of the latest entry, zero if the stream is empty.
+func (s *Stream) HeadTimestamp() (time.Time, error) {
+	cursor, err := s.WriteCursor()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cursor.HeadTimestamp()
+}
+
+// Write a state if the head of the stream is at expectedHead, zero for an empty stream.
+// Returns a *ConflictError if another writer moved the head, in which case
+// call ResetWriter, check the state and retry with the new HeadTimestamp.
+func (s *Stream) WriteStateIfHead(expectedHead time.Time, timestamp time.Time, state StateData) error {
+	return s.WriteStateIfHeadContext(context.Background(), expectedHead, timestamp, state)
+}
+
+// Write a state if the head of the stream is at expectedHead, with a context for the storage calls.
+func (s *Stream) WriteStateIfHeadContext(ctx context.Context, expectedHead time.Time, timestamp time.Time, state StateData) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	cursor, err := s.writeCursorContext(ctx)
+	if err != nil {
+		return err
+	}
+	return cursor.WriteStateIfHeadContext(ctx, expectedHead, timestamp, state, s.config.RecordRate)
+}
@@ -0,0 +1,125 @@
+package stream
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/paralin/mutate"
+)
+
+// The kind of change to a path of the state.
+type StateChangeType int
+
+const (
+	StateChangeAdded StateChangeType = iota
+	StateChangeRemoved
+	StateChangeChanged
+)
+
+// A change to the value at a dotted path. OldValue is nil for an added
+// path, NewValue is nil for a removed one.
+type StateChange struct {
+	Type     StateChangeType
+	Path     string
+	OldValue interface{}
+	NewValue interface{}
+}
+
+// The difference between the states at two times.
+type StateDiff struct {
+	From time.Time
+	To   time.Time
+	// Mutation from the state at From to the state at To, in the mutate format.
+	Mutation StateData
+	// The changed paths in order. Objects are compared key by key, other
+	// values including arrays are compared whole.
+	Changes []*StateChange
+}
+
+// Get the difference from the state at t1 to the state at t2. With no data at
+// a time, the state there is empty. A bidirectional cursor is moved from the
+// earlier time to the later one, so the entries between them are read once.
+func (s *Stream) Diff(t1, t2 time.Time) (*StateDiff, error) {
+	from, to := t1, t2
+	if to.Before(from) {
+		from, to = to, from
+	}
+	fromState, toState, err := s.statesAt(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if t2.Before(t1) {
+		fromState, toState = toState, fromState
+	}
+
+	diff := &StateDiff{From: t1, To: t2}
+	diffObjects("", fromState, toState, &diff.Changes)
+	diff.Mutation = mutate.BuildMutation(CloneStateData(fromState).StateData, CloneStateData(toState).StateData)
+	return diff, nil
+}
+
+// Get copies of the states at from and at the later time to.
+func (s *Stream) statesAt(from, to time.Time) (StateData, StateData, error) {
+	cursor, err := initCursorAt(s.storage, ReadBidirectionalCursor, from)
+	if err != nil {
+		return nil, nil, err
+	}
+	fromState := StateData{}
+	if cursor == nil {
+		// No data at from, start again at to.
+		cursor, err = initCursorAt(s.storage, ReadBidirectionalCursor, to)
+		if err != nil || cursor == nil {
+			return fromState, StateData{}, err
+		}
+	} else {
+		state, err := cursor.State()
+		if err != nil {
+			return nil, nil, err
+		}
+		fromState = CloneStateData(state).StateData
+		cursor.SetTimestamp(to)
+		if err := cursor.ComputeState(); err != nil {
+			return nil, nil, err
+		}
+	}
+	state, err := cursor.State()
+	if err != nil {
+		return nil, nil, err
+	}
+	return fromState, CloneStateData(state).StateData, nil
+}
+
+// Append the changes from oldObj to newObj, recursing into nested objects.
+func diffObjects(prefix string, oldObj, newObj map[string]interface{}, changes *[]*StateChange) {
+	keys := make([]string, 0, len(oldObj)+len(newObj))
+	for key := range oldObj {
+		keys = append(keys, key)
+	}
+	for key := range newObj {
+		if _, ok := oldObj[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		path := prefix + key
+		oldVal, inOld := oldObj[key]
+		newVal, inNew := newObj[key]
+		switch {
+		case !inNew:
+			*changes = append(*changes, &StateChange{Type: StateChangeRemoved, Path: path, OldValue: oldVal})
+		case !inOld:
+			*changes = append(*changes, &StateChange{Type: StateChangeAdded, Path: path, NewValue: newVal})
+		default:
+			oldChild, oldIsObj := asObject(oldVal)
+			newChild, newIsObj := asObject(newVal)
+			if oldIsObj && newIsObj {
+				diffObjects(path+".", oldChild, newChild, changes)
+			} else if !reflect.DeepEqual(oldVal, newVal) {
+				*changes = append(*changes, &StateChange{Type: StateChangeChanged, Path: path, OldValue: oldVal, NewValue: newVal})
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// A value a path of the state took, from Timestamp until the next value.
+// Value is nil when the path is not set.
+type PathValue struct {
+	Timestamp time.Time
+	Value     interface{}
+}
+
+// Get the distinct values at a dotted path like "sensors.temp" in [from, to].
+// The first value is the value at from, with from as its timestamp, unless the
+// stream has no data at from. Only the value at the path is tracked while
+// replaying from the snapshot before from, full states are not built.
+func (s *Stream) History(path string, from, to time.Time) ([]*PathValue, error) {
+	var res []*PathValue
+	err := s.replayPath(path, from, to, func(timestamp time.Time, value interface{}) error {
+		res = append(res, &PathValue{Timestamp: timestamp, Value: value})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Replay the value at path in [from, to], calling cb with the value at from
+// and then with each change, in order. Values must not be modified.
+func (s *Stream) replayPath(path string, from, to time.Time, cb func(timestamp time.Time, value interface{}) error) error {
+	keys, err := splitPath(path)
+	if err != nil {
+		return err
+	}
+	if to.Before(from) {
+		return errors.New("End of range must not be before the start.")
+	}
+
+	watcher := newPathWatcher(path, keys)
+	// GetSnapshotBefore excludes a snapshot exactly at from.
+	snap, err := s.storage.GetSnapshotBefore(from.Add(time.Nanosecond))
+	if err != nil {
+		return err
+	}
+	replayFrom := from
+	if snap != nil {
+		replayFrom = snap.Timestamp
+		if _, err := watcher.handleEntry(snap); err != nil {
+			return err
+		}
+	}
+
+	// With no data at from there is no value to start with.
+	sentInitial := snap == nil
+	sendInitial := func() error {
+		if sentInitial {
+			return nil
+		}
+		sentInitial = true
+		return cb(from, watcher.value)
+	}
+	err = forEachEntryBetween(s.storage, replayFrom, to, func(entry *StreamEntry) error {
+		if !entry.Timestamp.After(from) {
+			_, err := watcher.handleEntry(entry)
+			return err
+		}
+		if err := sendInitial(); err != nil {
+			return err
+		}
+		change, err := watcher.handleEntry(entry)
+		if err != nil || change == nil {
+			return err
+		}
+		return cb(entry.Timestamp, watcher.value)
+	})
+	if err != nil {
+		return err
+	}
+	return sendInitial()
+}
+
+// Call cb with each entry after from and at or before to, in order.
+// Entries are fetched in batches if storage supports range queries.
+func forEachEntryBetween(storage StorageBackend, from, to time.Time, cb func(entry *StreamEntry) error) error {
+	for {
+		entries, ok, err := getEntriesBetweenContext(context.Background(), storage, from, to, StreamEntryAny, fastForwardBatchSize)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		for _, entry := range entries {
+			if err := cb(entry); err != nil {
+				return err
+			}
+			from = entry.Timestamp
+		}
+		if len(entries) < fastForwardBatchSize {
+			return nil
+		}
+	}
+
+	for {
+		entry, err := storage.GetEntryAfter(from, StreamEntryAny)
+		if err != nil {
+			return err
+		}
+		if entry == nil || entry.Timestamp.After(to) {
+			return nil
+		}
+		if !entry.Timestamp.After(from) {
+			return errors.New("Storage backend returned an entry before requested time.")
+		}
+		if err := cb(entry); err != nil {
+			return err
+		}
+		from = entry.Timestamp
+	}
+}
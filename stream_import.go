@@ -0,0 +1,130 @@
+package stream
+
+import (
+	"errors"
+	"reflect"
+	"time"
+)
+
+// Number of entries Import saves per SaveEntries call, when the storage is a
+// BatchStorageBackend.
+const importBatchSize = 100
+
+// A source of states to import, in timestamp order.
+type StateIterator interface {
+	// Get the next state. Return a nil state at the end.
+	Next() (time.Time, StateData, error)
+}
+
+// Adapts a function to a StateIterator.
+type StateIteratorFunc func() (time.Time, StateData, error)
+
+func (f StateIteratorFunc) Next() (time.Time, StateData, error) {
+	return f()
+}
+
+// Bulk import historical states, laid out following the stream's rate config.
+// States at or before the latest entry of the stream are skipped, so an
+// interrupted import can be resumed by running it again from the start.
+// If the latest entry is a mutation, states in its amend window up to the
+// last one matching the stream state were amended into it and are skipped too.
+// Writes should not be made to the stream during the import.
+func (s *Stream) Import(iter StateIterator) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	cursor, err := s.WriteCursor()
+	if err != nil {
+		return err
+	}
+	err = cursor.WriteGuard(func() error {
+		var head, amendEnd time.Time
+		var lastState StateData
+		var lastSnapshot time.Time
+		if cursor.lastState != nil {
+			head = cursor.computedTimestamp
+			lastState = CloneStateData(cursor.computedState.StateData).StateData
+			lastSnapshot = cursor.lastSnapshot.Timestamp
+		}
+		if cursor.lastMutation != nil && cursor.lastMutation.Timestamp.Equal(head) {
+			amendEnd = head.Add(time.Duration(s.config.RecordRate.ChangeFrequency) * time.Millisecond)
+		}
+		return s.importStates(iter, head, amendEnd, newEntryBuilder(s.config.RecordRate, lastState, lastSnapshot))
+	})
+	// The write cursor is behind the imported entries.
+	s.ResetWriter()
+	return err
+}
+
+// States before amendEnd are held back until it is known which of them the
+// head mutation already covers.
+func (s *Stream) importStates(iter StateIterator, head, amendEnd time.Time, builder *entryBuilder) error {
+	last := head
+	headState := builder.lastState
+	var window []*TimestampedState
+	// Push the held back states after the last one the head mutation ends at.
+	// If none matches, the head mutation was not imported and all are pushed.
+	flushWindow := func() {
+		skip := 0
+		for i, st := range window {
+			if reflect.DeepEqual(st.State, headState) {
+				skip = i + 1
+			}
+		}
+		for _, st := range window[skip:] {
+			builder.push(st.Timestamp, st.State)
+		}
+		window = nil
+		amendEnd = time.Time{}
+	}
+	for {
+		timestamp, state, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if state == nil {
+			break
+		}
+		if builder.lastState != nil && !timestamp.After(last) {
+			if !timestamp.After(head) {
+				continue
+			}
+			return errors.New("Imported states must be in timestamp order.")
+		}
+		last = timestamp
+		state = CloneStateData(state).StateData
+		if timestamp.Before(amendEnd) {
+			window = append(window, &TimestampedState{Timestamp: timestamp, State: state})
+			continue
+		}
+		flushWindow()
+		builder.push(timestamp, state)
+
+		if len(builder.entries) > importBatchSize {
+			if err := s.saveEntries(builder.takeFinal()); err != nil {
+				return err
+			}
+		}
+	}
+	flushWindow()
+	return s.saveEntries(builder.finish())
+}
+
+// Save entries to storage, in one batch if the storage supports it.
+// Otherwise entries are saved one at a time, and an interrupted import may
+// stop part way through a batch. Running it again resumes after the last
+// saved entry.
+func (s *Stream) saveEntries(entries []*StreamEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if batch, ok := s.storage.(BatchStorageBackend); ok {
+		return batch.SaveEntries(entries)
+	}
+	for _, entry := range entries {
+		if err := s.storage.SaveEntry(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package stream
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/paralin/mutate"
+)
+
+// Write a state before the head of the stream, if timestamp is late.
+// Returns false if the state should be written by the write cursor instead.
+func (s *Stream) writeLateState(ctx context.Context, cursor *Cursor, timestamp time.Time, state StateData) (handled bool, err error) {
+	err = cursor.WriteGuard(func() error {
+		if cursor.lastState == nil || !timestamp.Before(cursor.computedTimestamp) {
+			return nil
+		}
+		handled = true
+		return s.insertState(ctx, timestamp, state)
+	})
+	if handled && err != LateEntryError {
+		// The write cursor may be holding an entry we rewrote.
+		s.ResetWriter()
+	}
+	return handled, err
+}
+
+// Insert a state at timestamp, between existing entries.
+// The entry at timestamp, if any, is replaced, and the following mutation
+// is rebuilt against the inserted state.
+func (s *Stream) insertState(ctx context.Context, timestamp time.Time, state StateData) error {
+	replay, err := newCursorReplay(s.storage, timestamp.Add(-time.Nanosecond))
+	if err != nil {
+		return err
+	}
+	prevState, err := replay.State()
+	if err != nil {
+		return err
+	}
+	var lastSnapshot time.Time
+	if snap := replay.LastSnapshot(); snap != nil {
+		lastSnapshot = snap.Timestamp
+	}
+
+	// Existing entry at the timestamp, and the one after it.
+	existing, existingState, err := replay.Next(timestamp)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		existingState = prevState
+	}
+	next, nextState, err := replay.Next(endOfTime)
+	if err != nil {
+		return err
+	}
+	if next == nil {
+		// The head mutation was amended with a later state, so the state at
+		// timestamp is not stored and cannot be inserted without changing it.
+		return LateEntryError
+	}
+	inputState := CloneStateData(state).StateData
+	if reflect.DeepEqual(existingState, inputState) {
+		return nil
+	}
+
+	keyframeFrequency := time.Duration(s.config.RecordRate.KeyframeFrequency) * time.Millisecond
+	entry := &StreamEntry{Timestamp: timestamp}
+	if prevState == nil || (existing != nil && existing.Type == StreamEntrySnapshot) ||
+		timestamp.Sub(lastSnapshot) >= keyframeFrequency {
+		entry.Type = StreamEntrySnapshot
+		entry.Data = inputState
+	} else {
+		entry.Type = StreamEntryMutation
+		entry.Data = mutate.BuildMutation(prevState, CloneStateData(inputState).StateData)
+	}
+
+	storage := WithContext(s.storage)
+	if existing != nil {
+		err = storage.AmendEntryContext(ctx, entry, timestamp)
+	} else {
+		err = storage.SaveEntryContext(ctx, entry)
+	}
+	if err != nil {
+		return err
+	}
+
+	// A snapshot after the inserted state does not depend on it.
+	if next.Type != StreamEntryMutation {
+		return nil
+	}
+	return storage.AmendEntryContext(ctx, &StreamEntry{
+		Type:      StreamEntryMutation,
+		Timestamp: next.Timestamp,
+		Data:      mutate.BuildMutation(CloneStateData(inputState).StateData, nextState),
+	}, next.Timestamp)
+}
@@ -0,0 +1,189 @@
+package stream
+
+import (
+	"errors"
+	"time"
+)
+
+// Re-structure the entries in (from, to] to follow newRate.
+// Entries are re-laid as if they were written with newRate, so with a
+// ChangeFrequency of 0 every state in the range is preserved, otherwise
+// changes closer together than ChangeFrequency are merged.
+func (s *Stream) Restructure(from, to time.Time, newRate *RateConfig) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.restructure(from, to, newRate, false)
+}
+
+// Re-structure the entries in (from, to], optionally dropping all mutations.
+// In snapshotsOnly mode one snapshot is kept per keyframe period, with the
+// state at the end of the period, so the state at to is always preserved.
+// If the last entry before from is a snapshot in the same period as the
+// first entry in the range, it is replaced, so a later call continues the
+// last period of an earlier call instead of starting a new one.
+// Note: Lock writeLock before calling
+func (s *Stream) restructure(from, to time.Time, newRate *RateConfig, snapshotsOnly bool) error {
+	if newRate == nil {
+		return errors.New("Rate config must be defined.")
+	}
+	if err := newRate.Validate(); err != nil {
+		return err
+	}
+	if !to.After(from) {
+		return errors.New("End of range must be after the start.")
+	}
+	pruner, ok := s.storage.(PrunableStorageBackend)
+	if !ok {
+		return errors.New("Storage backend does not support removing entries.")
+	}
+
+	replay, err := newCursorReplay(s.storage, from)
+	if err != nil {
+		return err
+	}
+	lastState, err := replay.State()
+	if err != nil {
+		return err
+	}
+	var lastSnapshot time.Time
+	if snap := replay.LastSnapshot(); snap != nil {
+		lastSnapshot = snap.Timestamp
+	}
+
+	builder := newEntryBuilder(newRate, lastState, lastSnapshot)
+	builder.snapshotsOnly = snapshotsOnly
+	var oldEntries []*StreamEntry
+	if snap := replay.LastSnapshot(); snapshotsOnly && snap != nil && snap.Timestamp.Equal(replay.ComputedTimestamp()) {
+		builder.continueSnapshot(snap)
+		oldEntries = append(oldEntries, snap)
+	}
+	for {
+		entry, state, err := replay.Next(to)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			break
+		}
+		oldEntries = append(oldEntries, entry)
+		builder.push(entry.Timestamp, state)
+	}
+	newEntries := builder.finish()
+
+	if err := s.replaceEntries(pruner, oldEntries, newEntries); err != nil {
+		return err
+	}
+
+	// The write cursor may be pointing at entries we removed.
+	s.ResetWriter()
+	return nil
+}
+
+// Merge changes in (from, to] so there is at most one mutation per granularity.
+// Snapshots are re-laid using the stream's keyframe frequency.
+func (s *Stream) Downsample(from, to time.Time, granularity time.Duration) error {
+	if granularity <= 0 {
+		return errors.New("Granularity must be > 0.")
+	}
+	return s.Restructure(from, to, &RateConfig{
+		KeyframeFrequency: s.config.RecordRate.KeyframeFrequency,
+		ChangeFrequency:   granularity.Nanoseconds() / 1000000,
+	})
+}
+
+// Delete every entry before timestamp. If the first remaining entry is a
+// mutation, it is replaced with a snapshot so the remaining states are unchanged.
+func (s *Stream) DeleteBefore(timestamp time.Time) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.deleteBefore(timestamp)
+}
+
+// Note: Lock writeLock before calling
+func (s *Stream) deleteBefore(timestamp time.Time) error {
+	pruner, ok := s.storage.(PrunableStorageBackend)
+	if !ok {
+		return errors.New("Storage backend does not support removing entries.")
+	}
+
+	first, err := s.storage.GetEntryAfter(timestamp.Add(-time.Nanosecond), StreamEntryAny)
+	if err != nil {
+		return err
+	}
+	if first != nil && first.Type == StreamEntryMutation {
+		cursor := s.BuildCursor(ReadForwardCursor)
+		if err := cursor.Init(first.Timestamp); err != nil {
+			return err
+		}
+		state, err := cursor.State()
+		if err != nil {
+			return err
+		}
+		snapshot := &StreamEntry{
+			Type:      StreamEntrySnapshot,
+			Timestamp: first.Timestamp,
+			Data:      CloneStateData(state).StateData,
+		}
+		if err := s.replaceEntries(pruner, []*StreamEntry{first}, []*StreamEntry{snapshot}); err != nil {
+			return err
+		}
+	}
+
+	entry, err := s.storage.GetEntryAfter(time.Time{}, StreamEntryAny)
+	for err == nil && entry != nil && entry.Timestamp.Before(timestamp) {
+		if err := pruner.RemoveEntry(entry.Timestamp); err != nil {
+			return err
+		}
+		entry, err = s.storage.GetEntryAfter(entry.Timestamp, StreamEntryAny)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.ResetWriter()
+	return nil
+}
+
+// Save the new entries, then remove the old entries they did not replace.
+// New entries are stored first so a failed write never loses the states in
+// the range, at worst old entries are left next to the new ones.
+func (s *Stream) replaceEntries(pruner PrunableStorageBackend, oldEntries, newEntries []*StreamEntry) error {
+	replaced := make(map[int64]bool, len(newEntries))
+	for _, entry := range newEntries {
+		replaced[entry.Timestamp.UnixNano()] = true
+	}
+
+	if batch, ok := s.storage.(BatchStorageBackend); ok {
+		if len(newEntries) > 0 {
+			if err := batch.SaveEntries(newEntries); err != nil {
+				return err
+			}
+		}
+	} else {
+		old := make(map[int64]bool, len(oldEntries))
+		for _, entry := range oldEntries {
+			old[entry.Timestamp.UnixNano()] = true
+		}
+		for _, entry := range newEntries {
+			var err error
+			if old[entry.Timestamp.UnixNano()] {
+				err = s.storage.AmendEntry(entry, entry.Timestamp)
+			} else {
+				err = s.storage.SaveEntry(entry)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, entry := range oldEntries {
+		if replaced[entry.Timestamp.UnixNano()] {
+			continue
+		}
+		if err := pruner.RemoveEntry(entry.Timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
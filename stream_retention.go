@@ -0,0 +1,90 @@
+package stream
+
+import (
+	"sync"
+	"time"
+)
+
+// Apply the retention policy in the config, as of now.
+// Each tier only re-structures entries that aged into it since the last call,
+// so the first call after startup processes the entire stream.
+func (s *Stream) ApplyRetention(now time.Time) error {
+	retention := s.config.Retention
+	if retention == nil {
+		return nil
+	}
+	if err := retention.Validate(); err != nil {
+		return err
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	var cutoff time.Time
+	if retention.MaxAge != 0 {
+		cutoff = now.Add(-time.Duration(retention.MaxAge) * time.Millisecond)
+		if err := s.deleteBefore(cutoff); err != nil {
+			return err
+		}
+	}
+
+	// Apply the oldest tier first, each tier ends where the next older one begins.
+	for i := len(retention.Tiers) - 1; i >= 0; i-- {
+		tier := retention.Tiers[i]
+		tierAge := time.Duration(tier.MinAge) * time.Millisecond
+		to := now.Add(-tierAge)
+		from := cutoff
+		if !s.retentionTimestamp.IsZero() {
+			if last := s.retentionTimestamp.Add(-tierAge); last.After(from) {
+				from = last
+			}
+		}
+		if to.After(from) {
+			if err := s.restructure(from, to, tier.RecordRate, tier.SnapshotsOnly); err != nil {
+				return err
+			}
+		}
+		cutoff = to
+	}
+
+	s.retentionTimestamp = now
+	return nil
+}
+
+// A background routine applying the retention policy.
+type StreamMaintenance interface {
+	Stop()
+}
+
+type streamMaintenance struct {
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+func (m *streamMaintenance) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopCh)
+	})
+}
+
+// Apply the retention policy every interval until stopped.
+// Errors are passed to errCb if it is not nil.
+func (s *Stream) StartMaintenance(interval time.Duration, errCb func(err error)) StreamMaintenance {
+	m := &streamMaintenance{stopCh: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.ApplyRetention(time.Now()); err != nil && errCb != nil {
+				errCb(err)
+			}
+			select {
+			case <-m.stopCh:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return m
+}
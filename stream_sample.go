@@ -0,0 +1,58 @@
+package stream
+
+import (
+	"errors"
+	"time"
+)
+
+// Get the state every interval in [from, to], starting at from.
+// Points before the stream has data are omitted. One read-forward cursor is
+// moved through the range, so entries are read once.
+func (s *Stream) Sample(from, to time.Time, interval time.Duration) ([]*TimestampedState, error) {
+	if interval <= 0 {
+		return nil, errors.New("Interval must be > 0.")
+	}
+	if to.Before(from) {
+		return nil, errors.New("End of range must not be before the start.")
+	}
+
+	var cursor *Cursor
+	var res []*TimestampedState
+	for timestamp := from; !timestamp.After(to); timestamp = timestamp.Add(interval) {
+		if cursor == nil {
+			var err error
+			cursor, err = initCursorAt(s.storage, ReadForwardCursor, timestamp)
+			if err != nil {
+				return nil, err
+			}
+			if cursor == nil {
+				// Skip the points before the first snapshot.
+				snap, err := s.storage.GetEntryAfter(timestamp, StreamEntrySnapshot)
+				if err != nil {
+					return nil, err
+				}
+				if snap == nil {
+					break
+				}
+				steps := (snap.Timestamp.Sub(timestamp) - 1) / interval
+				timestamp = timestamp.Add(steps * interval)
+				continue
+			}
+		} else {
+			cursor.SetTimestamp(timestamp)
+			if err := cursor.ComputeState(); err != nil {
+				return nil, err
+			}
+		}
+
+		state, err := cursor.State()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, &TimestampedState{
+			Timestamp: timestamp,
+			State:     CloneStateData(state).StateData,
+		})
+	}
+	return res, nil
+}
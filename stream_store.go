@@ -0,0 +1,90 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+)
+
+// Manages many streams over a shared storage backend, keyed by stream ID.
+// Open streams are cached, so each keeps its write cursor between calls.
+type StreamStore struct {
+	storage MultiStorageBackend
+	config  *Config
+
+	streams    map[string]*Stream
+	streamsMtx sync.Mutex
+}
+
+// Creates a new stream store. Streams use a default config if config is nil.
+func NewStreamStore(storage MultiStorageBackend, config *Config) (*StreamStore, error) {
+	if storage == nil {
+		return nil, errors.New("Storage must be defined.")
+	}
+	if config != nil {
+		if err := config.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &StreamStore{
+		storage: storage,
+		config:  config,
+		streams: make(map[string]*Stream),
+	}, nil
+}
+
+func (s *StreamStore) GetStorage() MultiStorageBackend {
+	return s.storage
+}
+
+// Get the stream with the ID, creating it if it does not exist.
+func (s *StreamStore) GetStream(streamId string) (*Stream, error) {
+	s.streamsMtx.Lock()
+	defer s.streamsMtx.Unlock()
+
+	if strm, ok := s.streams[streamId]; ok {
+		return strm, nil
+	}
+	storage, err := s.storage.OpenStream(streamId)
+	if err != nil {
+		return nil, err
+	}
+	var config *Config
+	if s.config != nil {
+		// Each stream gets its own copy, DisableAmends edits the rate config.
+		config = &Config{
+			RecordRate: &RateConfig{
+				KeyframeFrequency: s.config.RecordRate.KeyframeFrequency,
+				ChangeFrequency:   s.config.RecordRate.ChangeFrequency,
+			},
+			Retention: s.config.Retention,
+		}
+	}
+	strm, err := NewStream(storage, config)
+	if err != nil {
+		return nil, err
+	}
+	s.streams[streamId] = strm
+	return strm, nil
+}
+
+// List the IDs of the streams in storage.
+func (s *StreamStore) ListStreams() ([]string, error) {
+	return s.storage.ListStreams()
+}
+
+// Drop the stream with the ID from the cache. The stream is kept in storage.
+func (s *StreamStore) CloseStream(streamId string) {
+	s.streamsMtx.Lock()
+	defer s.streamsMtx.Unlock()
+
+	delete(s.streams, streamId)
+}
+
+// Delete the stream with the ID from storage.
+func (s *StreamStore) DeleteStream(streamId string) error {
+	s.streamsMtx.Lock()
+	defer s.streamsMtx.Unlock()
+
+	delete(s.streams, streamId)
+	return s.storage.DeleteStream(streamId)
+}
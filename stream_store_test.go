@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamStore(t *testing.T) {
+	store, err := NewStreamStore(NewMemoryMultiBackend(), nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	now := time.Now()
+	for _, id := range []string{"b", "a"} {
+		strm, err := store.GetStream(id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err := strm.WriteState(now, StateData{"id": id}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	// Open streams are cached with their write cursor.
+	strm, err := store.GetStream("a")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if strm.writeCursor == nil {
+		t.Fatalf("Expected the cached stream to keep its write cursor.")
+	}
+
+	// Re-opening after closing reads back from storage.
+	store.CloseStream("a")
+	reopened, err := store.GetStream("a")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if reopened == strm {
+		t.Fatalf("Expected CloseStream to drop the cached stream.")
+	}
+	cursor := reopened.BuildCursor(ReadForwardCursor)
+	if err := cursor.Init(now.Add(time.Second)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if state, _ := cursor.State(); state["id"] != "a" {
+		t.Fatalf("Unexpected state %v.", state)
+	}
+
+	ids, err := store.ListStreams()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "b" {
+		t.Fatalf("Unexpected streams %v.", ids)
+	}
+
+	if err := store.DeleteStream("a"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	ids, _ = store.ListStreams()
+	if len(ids) != 1 || ids[0] != "b" {
+		t.Fatalf("Unexpected streams after delete %v.", ids)
+	}
+	if _, err := store.GetStream(""); err == nil {
+		t.Fatalf("Expected an error for an empty stream ID.")
+	}
+}
@@ -1,10 +1,14 @@
 package stream
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/paralin/mutate"
 )
 
 func TestSimpleStreamWrite(t *testing.T) {
@@ -100,6 +104,90 @@ func TestStreamEntryWrite(t *testing.T) {
 	}
 }
 
+// Each new mutation must be built from the state before it, not the state
+// before the previous mutation.
+func TestStreamWriteMutationChain(t *testing.T) {
+	storageMock := &MockStorageBackend{Entries: []*StreamEntry{}}
+	stream, err := NewStream(storageMock, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	now := time.Now()
+	states := []string{`{"x":1}`, `{"x":1,"a":1}`, `{"x":1,"b":1}`}
+	for i, state := range states {
+		if err := CheckWriteState(stream, state, now.Add(time.Duration(i)*1200*time.Millisecond)); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if len(storageMock.Entries) != 3 {
+		t.Fatalf("Expected a snapshot and two mutations, got %d entries.", len(storageMock.Entries))
+	}
+
+	cursor := stream.BuildCursor(ReadForwardCursor)
+	if err := cursor.Init(now.Add(time.Hour)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	state, err := cursor.State()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected, _ := NewStateDataFromJson([]byte(states[2]))
+	if !reflect.DeepEqual(state, expected.StateData) {
+		t.Fatalf("Replayed state %v != written state %v.", state, expected.StateData)
+	}
+}
+
+// Applying the entries sent to a subscriber in order must give the written
+// state, also when a write amends the last mutation.
+func TestStreamWriteAmendSubscription(t *testing.T) {
+	storageMock := &MockStorageBackend{Entries: []*StreamEntry{}}
+	stream, err := NewStream(storageMock, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cursor, err := stream.WriteCursor()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ch := make(chan *StreamEntry, 10)
+	sub := cursor.SubscribeEntries(ch)
+	defer sub.Unsubscribe()
+
+	now := time.Now()
+	if err := CheckWriteState(stream, `{"x":1}`, now); err != nil {
+		t.Fatalf(err.Error())
+	}
+	now = now.Add(1200 * time.Millisecond)
+	if err := CheckWriteState(stream, `{"x":1,"a":1}`, now); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// Amends the last mutation.
+	now = now.Add(10 * time.Millisecond)
+	if err := CheckWriteState(stream, `{"x":1,"b":1}`, now); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(ch) != 3 {
+		t.Fatalf("Expected 3 entries, got %d.", len(ch))
+	}
+
+	var state map[string]interface{}
+	for len(ch) > 0 {
+		entry := <-ch
+		if entry.Type == StreamEntrySnapshot {
+			state = CloneStateData(entry.Data).StateData
+			continue
+		}
+		if state, err = mutate.ApplyMutationObject(state, CloneStateData(entry.Data).StateData); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	expected, _ := NewStateDataFromJson([]byte(`{"x":1,"b":1}`))
+	if !reflect.DeepEqual(StateData(state), expected.StateData) {
+		t.Fatalf("Subscriber state %v != written state %v.", state, expected.StateData)
+	}
+}
+
 func CheckWriteState(stream *Stream, state string, timestamp time.Time) error {
 	stateData, err := NewStateDataFromJson([]byte(state))
 	if err != nil {
@@ -156,3 +244,698 @@ func CheckWriteMutation(stream *Stream, state, expected string, timestamp time.T
 	}
 	return nil
 }
+
+// Write a state every 2 seconds for 5 minutes, changing every write.
+func buildTestStream(t *testing.T, start time.Time) (*Stream, *MemoryBackend) {
+	storage := &MemoryBackend{}
+	stream, err := NewStream(storage, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 0; i < 150; i++ {
+		state := StateData{"test": i, "even": i%2 == 0}
+		if err := stream.WriteState(start.Add(time.Duration(i*2)*time.Second), state); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	return stream, storage
+}
+
+// Replays every entry in the storage, returning the state at each timestamp.
+func replayAllStates(t *testing.T, storage StorageBackend, from time.Time) map[int64]StateData {
+	replay, err := newCursorReplay(storage, from)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	res := make(map[int64]StateData)
+	for {
+		entry, state, err := replay.Next(from.Add(time.Hour))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if entry == nil {
+			return res
+		}
+		res[entry.Timestamp.UnixNano()] = state
+	}
+}
+
+func countSnapshots(storage *MemoryBackend) int {
+	count := 0
+	for _, entry := range storage.Entries {
+		if entry.Type == StreamEntrySnapshot {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRestructure(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	stream, storage := buildTestStream(t, start)
+	if count := countSnapshots(storage); count != 5 {
+		t.Fatalf("Expected 5 snapshots before restructure, got %d.", count)
+	}
+	before := replayAllStates(t, storage, start.Add(-time.Second))
+
+	newRate := &RateConfig{
+		KeyframeFrequency: (time.Duration(10) * time.Minute).Nanoseconds() / 1000000,
+	}
+	// Leave the first two snapshots alone.
+	if err := stream.Restructure(start.Add(time.Minute+time.Second), start.Add(time.Hour), newRate); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if count := countSnapshots(storage); count != 2 {
+		t.Fatalf("Expected 2 snapshots after restructure, got %d.", count)
+	}
+
+	after := replayAllStates(t, storage, start.Add(-time.Second))
+	if !reflect.DeepEqual(before, after) {
+		t.Fatalf("States changed after restructure.")
+	}
+
+	// The stream should still be writable at the end.
+	if err := CheckWriteState(stream, `{"test":"final"}`, start.Add(time.Hour)); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+// A storage backend without batch writes, failing after a number of saves.
+type failingSaveBackend struct {
+	StorageBackend
+	saves int
+}
+
+func (b *failingSaveBackend) SaveEntry(entry *StreamEntry) error {
+	if b.saves == 0 {
+		return errors.New("Save failed.")
+	}
+	b.saves--
+	return b.StorageBackend.SaveEntry(entry)
+}
+
+func (b *failingSaveBackend) AmendEntry(entry *StreamEntry, oldTimestamp time.Time) error {
+	if b.saves == 0 {
+		return errors.New("Save failed.")
+	}
+	b.saves--
+	return b.StorageBackend.AmendEntry(entry, oldTimestamp)
+}
+
+func (b *failingSaveBackend) RemoveEntry(timestamp time.Time) error {
+	return b.StorageBackend.(PrunableStorageBackend).RemoveEntry(timestamp)
+}
+
+func TestRestructureFailedSave(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	_, storage := buildTestStream(t, start)
+	before := replayAllStates(t, storage, start.Add(-time.Second))
+
+	stream, err := NewStream(&failingSaveBackend{StorageBackend: storage, saves: 2}, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	newRate := &RateConfig{
+		KeyframeFrequency: (time.Duration(10) * time.Minute).Nanoseconds() / 1000000,
+	}
+	if err := stream.Restructure(start.Add(time.Minute+time.Second), start.Add(time.Hour), newRate); err == nil {
+		t.Fatalf("Expected the restructure to fail.")
+	}
+
+	after := replayAllStates(t, storage, start.Add(-time.Second))
+	if !reflect.DeepEqual(before, after) {
+		t.Fatalf("States changed after a failed restructure.")
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	stream, storage := buildTestStream(t, start)
+	end := start.Add(298 * time.Second)
+	before := replayAllStates(t, storage, start.Add(-time.Second))
+
+	if err := stream.Downsample(start.Add(-time.Second), start.Add(time.Hour), time.Minute); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// One snapshot and one mutation per minute.
+	if len(storage.Entries) != 10 || countSnapshots(storage) != 5 {
+		t.Fatalf("Expected 10 entries after downsample, got %d.", len(storage.Entries))
+	}
+
+	after := replayAllStates(t, storage, start.Add(-time.Second))
+	last := storage.Entries[len(storage.Entries)-1].Timestamp.UnixNano()
+	if !reflect.DeepEqual(before[end.UnixNano()], after[last]) {
+		t.Fatalf("Final state changed after downsample.")
+	}
+}
+
+func testRetentionConfig() *RetentionConfig {
+	return &RetentionConfig{
+		Tiers: []*RetentionTier{
+			{
+				MinAge: (time.Duration(1) * time.Minute).Nanoseconds() / 1000000,
+				RecordRate: &RateConfig{
+					KeyframeFrequency: (time.Duration(1) * time.Minute).Nanoseconds() / 1000000,
+				},
+				SnapshotsOnly: true,
+			},
+		},
+		MaxAge: (time.Duration(58) * time.Minute).Nanoseconds() / 1000000,
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	// Align to the minute, so the kept minutes are known.
+	now := time.Now().Truncate(time.Minute)
+	start := now.Add(-time.Hour)
+	stream, storage := buildTestStream(t, start)
+	end := start.Add(298 * time.Second)
+	before := replayAllStates(t, storage, start.Add(-time.Second))
+
+	stream.config.Retention = testRetentionConfig()
+	if err := stream.ApplyRetention(now); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// One snapshot for each of the 3 minutes after the max age.
+	if len(storage.Entries) != 3 || countSnapshots(storage) != 3 {
+		t.Fatalf("Expected 3 snapshots after retention, got %d entries.", len(storage.Entries))
+	}
+	if first := storage.Entries[0].Timestamp; first.Before(now.Add(-58 * time.Minute)) {
+		t.Fatalf("Entry at %v was not deleted.", first)
+	}
+	after := replayAllStates(t, storage, start.Add(-time.Second))
+	if !reflect.DeepEqual(before[end.UnixNano()], after[end.UnixNano()]) {
+		t.Fatalf("Final state changed after retention.")
+	}
+}
+
+// Applying retention as time passes must give the same entries as applying
+// it once at the end.
+func TestApplyRetentionIncremental(t *testing.T) {
+	now := time.Now()
+	start := now.Add(-time.Hour)
+	once, onceStorage := buildTestStream(t, start)
+	incremental, incrementalStorage := buildTestStream(t, start)
+	once.config.Retention = testRetentionConfig()
+	incremental.config.Retention = testRetentionConfig()
+
+	if err := once.ApplyRetention(now); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for ts := start.Add(time.Minute); ts.Before(now); ts = ts.Add(7 * time.Second) {
+		if err := incremental.ApplyRetention(ts); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := incremental.ApplyRetention(now); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if len(onceStorage.Entries) != len(incrementalStorage.Entries) {
+		t.Fatalf("Expected %d entries, got %d.", len(onceStorage.Entries), len(incrementalStorage.Entries))
+	}
+	for i, entry := range onceStorage.Entries {
+		other := incrementalStorage.Entries[i]
+		if !entry.Timestamp.Equal(other.Timestamp) || entry.Type != other.Type || !reflect.DeepEqual(entry.Data, other.Data) {
+			t.Fatalf("Entry %d differs: %v != %v.", i, entry, other)
+		}
+	}
+}
+
+func TestLateWrites(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	stream, storage := buildTestStream(t, start)
+	before := replayAllStates(t, storage, start.Add(-time.Second))
+
+	late := start.Add(time.Duration(21) * time.Second)
+	if err := stream.WriteState(late, StateData{"test": "late"}); err != LateEntryError {
+		t.Fatalf("Expected LateEntryError, got %v.", err)
+	}
+
+	stream.EnableLateWrites()
+	if err := stream.WriteState(late, StateData{"test": "late"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// Replace an existing mutation and an existing snapshot.
+	replaced := start.Add(time.Duration(40) * time.Second)
+	if err := stream.WriteState(replaced, StateData{"test": "replaced"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := stream.WriteState(start, StateData{"test": "first"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// The head keeps working after a late write.
+	head := start.Add(time.Duration(300) * time.Second)
+	if err := stream.WriteState(head, StateData{"test": "head"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	after := replayAllStates(t, storage, start.Add(-time.Second))
+	if len(after) != len(before)+2 {
+		t.Fatalf("Expected %d entries, got %d.", len(before)+2, len(after))
+	}
+	expected := map[int64]interface{}{
+		late.UnixNano():     "late",
+		replaced.UnixNano(): "replaced",
+		start.UnixNano():    "first",
+		head.UnixNano():     "head",
+	}
+	for ts, state := range before {
+		if _, ok := expected[ts]; ok {
+			continue
+		}
+		if !reflect.DeepEqual(after[ts], state) {
+			t.Fatalf("State at %v changed from %v to %v.", time.Unix(0, ts), state, after[ts])
+		}
+	}
+	for ts, value := range expected {
+		if state := after[ts]; state["test"] != value {
+			t.Fatalf("Expected %v at %v, got %v.", value, time.Unix(0, ts), state)
+		}
+	}
+}
+
+func TestLateWriteAmendedHead(t *testing.T) {
+	storage := &MemoryBackend{}
+	stream, err := NewStream(storage, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	stream.EnableLateWrites()
+	start := time.Now().Add(-time.Hour)
+	mutation := start.Add(2 * time.Second)
+	for i, ts := range []time.Time{start, mutation, mutation.Add(500 * time.Millisecond)} {
+		if err := stream.WriteState(ts, StateData{"test": i}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if len(storage.Entries) != 2 {
+		t.Fatalf("Expected the last state to amend the mutation, got %d entries.", len(storage.Entries))
+	}
+	before := replayAllStates(t, storage, start.Add(-time.Second))
+
+	// The head mutation holds the state at 2.5 seconds.
+	for _, ts := range []time.Time{mutation, mutation.Add(200 * time.Millisecond)} {
+		if err := stream.WriteState(ts, StateData{"test": "late"}); err != LateEntryError {
+			t.Fatalf("Expected LateEntryError at %v, got %v.", ts, err)
+		}
+	}
+	if after := replayAllStates(t, storage, start.Add(-time.Second)); !reflect.DeepEqual(after, before) {
+		t.Fatalf("Rejected late writes changed the stream.")
+	}
+
+	// States before the head mutation are still inserted.
+	if err := stream.WriteState(start.Add(time.Second), StateData{"test": "late"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(storage.Entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d.", len(storage.Entries))
+	}
+}
+
+// Iterates over the states written by buildTestStream, failing after failAfter states.
+func testStateIterator(start time.Time, failAfter int) StateIterator {
+	i := 0
+	return StateIteratorFunc(func() (time.Time, StateData, error) {
+		if i == failAfter {
+			return time.Time{}, nil, errors.New("Iterator failed.")
+		}
+		if i == 150 {
+			return time.Time{}, nil, nil
+		}
+		timestamp := start.Add(time.Duration(i*2) * time.Second)
+		state := StateData{"test": i, "even": i%2 == 0}
+		i++
+		return timestamp, state, nil
+	})
+}
+
+func TestImport(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	_, written := buildTestStream(t, start)
+	expected := replayAllStates(t, written, start.Add(-time.Second))
+	for _, state := range expected {
+		if even := int(state["test"].(float64))%2 == 0; state["even"] != even {
+			t.Fatalf("Write cursor stored a wrong state %v.", state)
+		}
+	}
+
+	storage := &MemoryBackend{}
+	stream, err := NewStream(storage, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := stream.Import(testStateIterator(start, 70)); err == nil {
+		t.Fatalf("Expected the iterator error.")
+	}
+	// Resume from the start.
+	if err := stream.Import(testStateIterator(start, -1)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(storage.Entries) != len(written.Entries) {
+		t.Fatalf("Expected %d entries, got %d.", len(written.Entries), len(storage.Entries))
+	}
+	if imported := replayAllStates(t, storage, start.Add(-time.Second)); !reflect.DeepEqual(imported, expected) {
+		t.Fatalf("Imported states do not match written states.")
+	}
+
+	// The stream can be written after an import.
+	if err := stream.WriteState(start.Add(time.Hour), StateData{"test": "after"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+func TestImportResumeAmended(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	// States 300ms apart, so most mutations are amended by later states.
+	states := func() StateIterator {
+		i := 0
+		return StateIteratorFunc(func() (time.Time, StateData, error) {
+			if i == 60 {
+				return time.Time{}, nil, nil
+			}
+			timestamp := start.Add(time.Duration(i*300) * time.Millisecond)
+			state := StateData{"test": i}
+			i++
+			return timestamp, state, nil
+		})
+	}
+
+	expected := &MemoryBackend{}
+	stream, err := NewStream(expected, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := stream.Import(states()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Stop the import after each number of saved entries, then resume it.
+	for saves := 2; saves < len(expected.Entries); saves++ {
+		storage := &failingSaveBackend{StorageBackend: &MemoryBackend{}, saves: saves}
+		stream, err := NewStream(storage, nil)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err := stream.Import(states()); err == nil {
+			t.Fatalf("Expected the save error.")
+		}
+		storage.saves = -1
+		if err := stream.Import(states()); err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		imported := storage.StorageBackend.(*MemoryBackend)
+		if len(imported.Entries) != len(expected.Entries) {
+			t.Fatalf("Resumed after %d saves, expected %d entries, got %d.", saves, len(expected.Entries), len(imported.Entries))
+		}
+		for i, entry := range imported.Entries {
+			if exp := expected.Entries[i]; entry.Type != exp.Type || !entry.Timestamp.Equal(exp.Timestamp) || !reflect.DeepEqual(entry.Data, exp.Data) {
+				t.Fatalf("Resumed after %d saves, entry %d differs: %v, expected %v.", saves, i, entry, exp)
+			}
+		}
+	}
+}
+
+func TestWriteStateIfHeadContext(t *testing.T) {
+	storage := &MemoryBackend{}
+	stream, err := NewStream(storage, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	now := time.Now()
+	if err := stream.WriteStateIfHead(time.Time{}, now, StateData{"test": 1}); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = stream.WriteStateIfHeadContext(ctx, now, now.Add(2*time.Second), StateData{"test": 2})
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v.", err)
+	}
+	if len(storage.Entries) != 1 {
+		t.Fatalf("Canceled write stored an entry.")
+	}
+	stream.ResetWriter()
+	if err := stream.WriteStateIfHeadContext(context.Background(), now, now.Add(2*time.Second), StateData{"test": 2}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(storage.Entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d.", len(storage.Entries))
+	}
+}
+
+// A memory backend failing batch writes when fail is set.
+type failingBatchBackend struct {
+	*MemoryBackend
+	fail bool
+}
+
+func (b *failingBatchBackend) SaveEntries(entries []*StreamEntry) error {
+	if b.fail {
+		return errors.New("Batch failed.")
+	}
+	return b.MemoryBackend.SaveEntries(entries)
+}
+
+func TestWriteBatch(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	_, written := buildTestStream(t, start)
+	expected := replayAllStates(t, written, start.Add(-time.Second))
+
+	storage := &failingBatchBackend{MemoryBackend: &MemoryBackend{}}
+	stream, err := NewStream(storage, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var batch []*StateWrite
+	for i := 0; i < 150; i++ {
+		batch = append(batch, &StateWrite{
+			Timestamp: start.Add(time.Duration(i*2) * time.Second),
+			State:     StateData{"test": i, "even": i%2 == 0},
+		})
+		if len(batch) < 50 {
+			continue
+		}
+		// A failed batch stores nothing and leaves the writer as it was.
+		storage.fail = true
+		count := len(storage.Entries)
+		if err := stream.WriteBatch(batch); err == nil {
+			t.Fatalf("Expected the batch to fail.")
+		}
+		if len(storage.Entries) != count {
+			t.Fatalf("Failed batch stored %d entries.", len(storage.Entries)-count)
+		}
+		storage.fail = false
+		if err := stream.WriteBatch(batch); err != nil {
+			t.Fatalf(err.Error())
+		}
+		batch = nil
+	}
+
+	if imported := replayAllStates(t, storage, start.Add(-time.Second)); !reflect.DeepEqual(imported, expected) {
+		t.Fatalf("Batched states do not match written states.")
+	}
+
+	unbatched, _ := NewStream(&MockStorageBackend{}, nil)
+	if err := unbatched.WriteBatch(batch); err == nil {
+		t.Fatalf("Expected an error for a backend without batch support.")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	stream, storage := buildTestStream(t, start)
+	// The same entries without range queries.
+	mockStream, err := NewStream(&MockStorageBackend{Entries: storage.Entries}, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for _, s := range []*Stream{stream, mockStream} {
+		history, err := s.History("even", start.Add(61*time.Second), start.Add(70*time.Second))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if len(history) != 6 {
+			t.Fatalf("Expected 6 values, got %d.", len(history))
+		}
+		if !history[0].Timestamp.Equal(start.Add(61*time.Second)) || history[0].Value != true {
+			t.Fatalf("Unexpected initial value %v at %v.", history[0].Value, history[0].Timestamp)
+		}
+		for i, val := range history[1:] {
+			if !val.Timestamp.Equal(start.Add(time.Duration(62+i*2)*time.Second)) || val.Value != (i%2 == 1) {
+				t.Fatalf("Unexpected value %v at %v.", val.Value, val.Timestamp)
+			}
+		}
+	}
+
+	// Unchanged values are not repeated.
+	history, err := stream.History("missing", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(history) != 1 || history[0].Value != nil {
+		t.Fatalf("Expected a single nil value, got %d values.", len(history))
+	}
+	// No data before the stream starts.
+	history, err = stream.History("test", start.Add(-time.Minute), start.Add(time.Second))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(history) != 1 || !history[0].Timestamp.Equal(start) {
+		t.Fatalf("Expected the first value at the start of the stream.")
+	}
+}
+
+func TestSample(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	stream, storage := buildTestStream(t, start)
+	mockStream, err := NewStream(&MockStorageBackend{Entries: storage.Entries}, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	states := replayAllStates(t, storage, start.Add(-time.Second))
+
+	for _, s := range []*Stream{stream, mockStream} {
+		// The first points are before the stream starts.
+		samples, err := s.Sample(start.Add(-35*time.Second), start.Add(200*time.Second), 5*time.Second)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if len(samples) != 41 {
+			t.Fatalf("Expected 41 samples, got %d.", len(samples))
+		}
+		for i, sample := range samples {
+			timestamp := start.Add(time.Duration(i*5) * time.Second)
+			// States are written every 2 seconds.
+			expected := states[start.Add(time.Duration(i*5/2*2)*time.Second).UnixNano()]
+			if !sample.Timestamp.Equal(timestamp) || !reflect.DeepEqual(sample.State, expected) {
+				t.Fatalf("Unexpected sample %v at %v, expected %v at %v.", sample.State, sample.Timestamp, expected, timestamp)
+			}
+		}
+	}
+
+	if _, err := stream.Sample(start, start.Add(time.Minute), 0); err == nil {
+		t.Fatalf("Expected an error for a zero interval.")
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	// "test" is i at i*2 seconds, so 5 values per 10 second window.
+	stream, _ := buildTestStream(t, start)
+
+	expected := map[AggregateFunc][]float64{
+		AggregateMin:              {0, 5, 10},
+		AggregateMax:              {4, 9, 14},
+		AggregateMean:             {2, 7, 12},
+		AggregateTimeWeightedMean: {2, 7, 12},
+		AggregateLast:             {4, 9, 14},
+	}
+	for fn, values := range expected {
+		windows, err := stream.Aggregate("test", start, start.Add(30*time.Second), 10*time.Second, fn)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if len(windows) != len(values) {
+			t.Fatalf("Expected %d windows, got %d.", len(values), len(windows))
+		}
+		for i, w := range windows {
+			if !w.Valid || w.Value != values[i] || !w.Start.Equal(start.Add(time.Duration(i*10)*time.Second)) {
+				t.Fatalf("Aggregate %d window %d: got %v (valid %v), expected %v.", fn, i, w.Value, w.Valid, values[i])
+			}
+		}
+	}
+
+	// Windows start mid-value and the last window is cut short.
+	windows, err := stream.Aggregate("test", start.Add(time.Second), start.Add(6*time.Second), 4*time.Second, AggregateTimeWeightedMean)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// 0 for 1s, 1 for 2s, 2 for 1s; then 2 for 1s.
+	if len(windows) != 2 || windows[0].Value != 1 || windows[1].Value != 2 || !windows[1].End.Equal(start.Add(6*time.Second)) {
+		t.Fatalf("Unexpected windows %v, %v.", windows[0], windows[1])
+	}
+
+	// Non-numeric fields have no value.
+	windows, err = stream.Aggregate("even", start, start.Add(10*time.Second), 10*time.Second, AggregateMean)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(windows) != 1 || windows[0].Valid {
+		t.Fatalf("Expected an invalid window for a non-numeric field.")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	stream, err := NewStream(&MemoryBackend{}, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	states := []string{
+		`{"a":1,"obj":{"x":1,"y":2},"gone":true}`,
+		`{"a":2,"obj":{"x":1,"y":3,"z":[1]},"gone":true}`,
+		`{"a":2,"obj":{"x":1,"y":3,"z":[1,2]},"added":"yes"}`,
+	}
+	for i, state := range states {
+		if err := CheckWriteState(stream, state, start.Add(time.Duration(i*90)*time.Second)); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	diff, err := stream.Diff(start, start.Add(3*time.Minute))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := []StateChange{
+		{Type: StateChangeChanged, Path: "a", OldValue: float64(1), NewValue: float64(2)},
+		{Type: StateChangeAdded, Path: "added", NewValue: "yes"},
+		{Type: StateChangeRemoved, Path: "gone", OldValue: true},
+		{Type: StateChangeChanged, Path: "obj.y", OldValue: float64(2), NewValue: float64(3)},
+		{Type: StateChangeAdded, Path: "obj.z", NewValue: []interface{}{float64(1), float64(2)}},
+	}
+	if len(diff.Changes) != len(expected) {
+		t.Fatalf("Expected %d changes, got %d.", len(expected), len(diff.Changes))
+	}
+	for i, change := range diff.Changes {
+		if !reflect.DeepEqual(*change, expected[i]) {
+			t.Fatalf("Unexpected change %v, expected %v.", *change, expected[i])
+		}
+	}
+
+	// Applying the mutation to the first state gives the second.
+	checkMutation := func(diff *StateDiff, from, to string) {
+		fromState, _ := NewStateDataFromJson([]byte(from))
+		toState, _ := NewStateDataFromJson([]byte(to))
+		res, err := mutate.ApplyMutationObject(fromState.StateData, diff.Mutation)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !reflect.DeepEqual(StateData(res), toState.StateData) {
+			t.Fatalf("Mutation %v does not transform %s to %s.", diff.Mutation, from, to)
+		}
+	}
+	checkMutation(diff, states[0], states[2])
+
+	diff, err = stream.Diff(start.Add(3*time.Minute), start.Add(time.Minute))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(diff.Changes) != 5 || diff.Changes[1].Path != "added" || diff.Changes[1].Type != StateChangeRemoved {
+		t.Fatalf("Unexpected reversed diff.")
+	}
+	checkMutation(diff, states[2], states[0])
+
+	// The stream is empty before it starts.
+	diff, err = stream.Diff(start.Add(-time.Minute), start)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(diff.Changes) != 3 {
+		t.Fatalf("Expected 3 added paths, got %d changes.", len(diff.Changes))
+	}
+}
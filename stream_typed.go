@@ -0,0 +1,102 @@
+//go:build go1.18
+// +build go1.18
+
+// The typed stream API uses generics and is only built with Go 1.18 or later.
+
+package stream
+
+import (
+	"time"
+)
+
+// A stream of states of type T. States are stored as the JSON encoding of T,
+// so T must encode to a JSON object.
+type TypedStream[T any] struct {
+	stream *Stream
+}
+
+func NewTypedStream[T any](stream *Stream) *TypedStream[T] {
+	return &TypedStream[T]{stream: stream}
+}
+
+// Get the underlying stream.
+func (s *TypedStream[T]) Stream() *Stream {
+	return s.stream
+}
+
+// Write a state to the end of the stream.
+func (s *TypedStream[T]) WriteState(timestamp time.Time, state T) error {
+	data, err := EncodeState(state)
+	if err != nil {
+		return err
+	}
+	return s.stream.WriteState(timestamp, data)
+}
+
+// Build a cursor decoding states into T.
+func (s *TypedStream[T]) BuildCursor(cursorType CursorType) *TypedCursor[T] {
+	return &TypedCursor[T]{cursor: s.stream.BuildCursor(cursorType)}
+}
+
+// A cursor over a TypedStream.
+type TypedCursor[T any] struct {
+	cursor *Cursor
+}
+
+// Get the underlying cursor.
+func (c *TypedCursor[T]) Cursor() *Cursor {
+	return c.cursor
+}
+
+func (c *TypedCursor[T]) Init(timestamp time.Time) error {
+	return c.cursor.Init(timestamp)
+}
+
+func (c *TypedCursor[T]) SetTimestamp(timestamp time.Time) {
+	c.cursor.SetTimestamp(timestamp)
+}
+
+func (c *TypedCursor[T]) ComputeState() error {
+	return c.cursor.ComputeState()
+}
+
+// Get the computed state. Returns a *StateDecodeError if it does not decode into T.
+func (c *TypedCursor[T]) State() (T, error) {
+	data, err := c.cursor.State()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return c.decode(c.cursor.ComputedTimestamp(), data)
+}
+
+// Move to the next stored entry, see Cursor.Next.
+func (c *TypedCursor[T]) Next() (time.Time, T, error) {
+	timestamp, data, err := c.cursor.Next()
+	if err != nil {
+		var zero T
+		return timestamp, zero, err
+	}
+	state, err := c.decode(timestamp, data)
+	return timestamp, state, err
+}
+
+// Move to the previous stored entry, see Cursor.Prev.
+func (c *TypedCursor[T]) Prev() (time.Time, T, error) {
+	timestamp, data, err := c.cursor.Prev()
+	if err != nil {
+		var zero T
+		return timestamp, zero, err
+	}
+	state, err := c.decode(timestamp, data)
+	return timestamp, state, err
+}
+
+func (c *TypedCursor[T]) decode(timestamp time.Time, data StateData) (T, error) {
+	var state T
+	if err := DecodeState(data, &state); err != nil {
+		var zero T
+		return zero, &StateDecodeError{Timestamp: timestamp, Err: err}
+	}
+	return state, nil
+}
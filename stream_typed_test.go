@@ -0,0 +1,84 @@
+//go:build go1.18
+// +build go1.18
+
+package stream
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type testTypedState struct {
+	Setpoint float64 `json:"setpoint"`
+	Mode     string  `json:"mode"`
+	Zones    []int   `json:"zones,omitempty"`
+}
+
+func TestTypedStream(t *testing.T) {
+	storage := &MemoryBackend{}
+	base, err := NewStream(storage, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	stream := NewTypedStream[testTypedState](base)
+
+	start := time.Now().Add(-time.Hour)
+	written := []testTypedState{
+		{Setpoint: 20, Mode: "heat"},
+		{Setpoint: 21.5, Mode: "heat", Zones: []int{1, 2}},
+		{Setpoint: 18, Mode: "cool", Zones: []int{2}},
+	}
+	for i, state := range written {
+		if err := stream.WriteState(start.Add(time.Duration(i*2)*time.Second), state); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if storage.Entries[1].Type != StreamEntryMutation {
+		t.Fatalf("Expected typed writes to be stored as mutations.")
+	}
+
+	cursor := stream.BuildCursor(ReadBidirectionalCursor)
+	if err := cursor.Init(start.Add(3 * time.Second)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	state, err := cursor.State()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if state.Setpoint != 21.5 || state.Mode != "heat" || len(state.Zones) != 2 {
+		t.Fatalf("Unexpected state %+v.", state)
+	}
+	_, state, err = cursor.Next()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if state.Mode != "cool" || len(state.Zones) != 1 {
+		t.Fatalf("Unexpected state %+v after Next.", state)
+	}
+	_, state, err = cursor.Prev()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if state.Setpoint != 21.5 {
+		t.Fatalf("Unexpected state %+v after Prev.", state)
+	}
+
+	// A state written with another type no longer decodes.
+	if err := base.WriteState(start.Add(10*time.Second), StateData{"setpoint": "warm"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	cursor.SetTimestamp(start.Add(10 * time.Second))
+	if err := cursor.ComputeState(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = cursor.State()
+	var decodeErr *StateDecodeError
+	if !errors.As(err, &decodeErr) || !decodeErr.Timestamp.Equal(start.Add(10*time.Second)) {
+		t.Fatalf("Expected a decode error, got %v.", err)
+	}
+
+	if _, err := EncodeState([]int{1}); err == nil {
+		t.Fatalf("Expected an error encoding a non-object state.")
+	}
+}